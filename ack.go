@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+const AckAction = "ack"
+const DeliveryReceiptAction = "delivery_receipt"
+const DeliveryFailedAction = "delivery_failed"
+
+// ReceiptWebhook as the receipt_to of a message sends its delivery receipts
+// to the app's webhook instead of a socket.
+const ReceiptWebhook = "webhook"
+
+const (
+	// How long a client has to ack a message before it is sent again, when
+	// the app doesn't set AckTimeout.
+	defaultAckTimeout = 10 * time.Second
+
+	// How often unacked messages are checked for redelivery.
+	ackCheckPeriod = time.Second
+
+	// Deliveries of a message before giving up on a client that never acks.
+	maxDeliveryAttempts = 5
+)
+
+var errAckUnknown = errors.New("no message waiting for an ack with this id")
+
+// pendingAck is a message sent on an ack channel that the client has not
+// acked yet. ReceiptTo is where the delivery receipt goes, if one was asked for.
+// Order is the position of its first send among the client's pending acks.
+type pendingAck struct {
+	id        string
+	frame     []byte
+	channel   string
+	receiptTo string
+	order     uint64
+	sent      time.Time
+	attempts  int
+}
+
+// DeliveryReceipt is the data of a delivery_receipt, sent to the socket a
+// message named in receipt_to once a client acked it, or of a delivery_failed
+// once the client was given up on.
+type DeliveryReceipt struct {
+	ID       string `json:"id"`
+	SocketID string `json:"socket_id"`
+	UserID   string `json:"user_id,omitempty"`
+}
+
+// expectAck tracks a message sent to the client on an ack channel.
+func (client *Client) expectAck(channel *Channel, message *Message, frame []byte) {
+	pending := &pendingAck{
+		id:       message.ID,
+		frame:    frame,
+		channel:  channel.Name,
+		sent:     time.Now(),
+		attempts: 1,
+	}
+
+	if message.Receipt {
+		pending.receiptTo = message.receiptTo
+	}
+
+	client.acksMu.Lock()
+	client.ackOrder++
+	pending.order = client.ackOrder
+	client.acks[message.ID] = pending
+	client.acksMu.Unlock()
+}
+
+// handleAck forgets an acked message, sending the delivery receipt the sender
+// asked for.
+func (client *Client) handleAck(message Message) {
+	client.acksMu.Lock()
+	pending, ok := client.acks[message.ID]
+	delete(client.acks, message.ID)
+	client.acksMu.Unlock()
+
+	if !ok {
+		client.sendError(message.Name, ErrorCodeBadRequest, errAckUnknown.Error())
+		return
+	}
+
+	client.sendReceipt(pending, DeliveryReceiptAction)
+}
+
+// sendReceipt tells the receipt target of a message, if any, that the client
+// acked it or was given up on.
+func (client *Client) sendReceipt(pending *pendingAck, action string) {
+	switch pending.receiptTo {
+
+	case "":
+		return
+
+	case ReceiptWebhook:
+		go sendWebhook(client.wsServer.app.WebhookURL, WebhookPayload{
+			ClientID:  client.GetId(),
+			UserID:    client.UserID,
+			Channel:   pending.channel,
+			Event:     action,
+			MessageID: pending.id,
+		})
+		return
+	}
+
+	data, err := json.Marshal(DeliveryReceipt{
+		ID:       pending.id,
+		SocketID: client.GetId(),
+		UserID:   client.UserID,
+	})
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	client.wsServer.sendToSocket(pending.receiptTo, &Message{
+		Action:    action,
+		Event:     action,
+		Name:      pending.channel,
+		Data:      data,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+// dropAcks forgets the unacked messages of a channel the client left.
+func (client *Client) dropAcks(channelName string) {
+	client.acksMu.Lock()
+	defer client.acksMu.Unlock()
+
+	for id, pending := range client.acks {
+		if pending.channel == channelName {
+			delete(client.acks, id)
+		}
+	}
+}
+
+// dueAcks returns the unacked messages last sent before deadline, in the
+// order they were first sent, counting them as sent again. Messages sent too
+// often are given up on, with a delivery_failed to their receipt target.
+func (client *Client) dueAcks(deadline time.Time) [][]byte {
+	var due []*pendingAck
+	var failed []*pendingAck
+
+	client.acksMu.Lock()
+
+	for id, pending := range client.acks {
+		if pending.sent.After(deadline) {
+			continue
+		}
+
+		if pending.attempts >= maxDeliveryAttempts {
+			log.Printf("Giving up on delivering message %s to client %s", id, client.GetId())
+			delete(client.acks, id)
+			failed = append(failed, pending)
+			continue
+		}
+
+		due = append(due, pending)
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].order < due[j].order
+	})
+
+	frames := make([][]byte, 0, len(due))
+
+	for _, pending := range due {
+		pending.sent = time.Now()
+		pending.attempts++
+
+		frames = append(frames, pending.frame)
+	}
+
+	client.acksMu.Unlock()
+
+	// The write pump calls this, and receipts can come back to this socket
+	for _, pending := range failed {
+		go client.sendReceipt(pending, DeliveryFailedAction)
+	}
+
+	return frames
+}
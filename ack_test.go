@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestExpectAckReceiptTarget(t *testing.T) {
+	client := &Client{acks: make(map[string]*pendingAck)}
+	channel := &Channel{Name: "orders"}
+
+	tests := []struct {
+		message *Message
+		want    string
+	}{
+		{&Message{ID: "a"}, ""},
+		{&Message{ID: "b", Receipt: true, receiptTo: "socket"}, "socket"},
+		{&Message{ID: "c", Receipt: true, receiptTo: ReceiptWebhook}, ReceiptWebhook},
+		{&Message{ID: "d", receiptTo: "socket"}, ""},
+	}
+
+	for _, test := range tests {
+		client.expectAck(channel, test.message, nil)
+
+		if got := client.acks[test.message.ID].receiptTo; got != test.want {
+			t.Errorf("message %s: got receipt target %q, want %q", test.message.ID, got, test.want)
+		}
+	}
+}
+
+func TestDropAcks(t *testing.T) {
+	client := &Client{acks: make(map[string]*pendingAck)}
+
+	client.expectAck(&Channel{Name: "a"}, &Message{ID: "1"}, nil)
+	client.expectAck(&Channel{Name: "b"}, &Message{ID: "2"}, nil)
+
+	client.dropAcks("a")
+
+	if _, ok := client.acks["1"]; ok {
+		t.Errorf("kept the ack of the channel left")
+	}
+
+	if _, ok := client.acks["2"]; !ok {
+		t.Errorf("dropped the ack of another channel")
+	}
+}
+
+func TestDueAcksInFirstSentOrder(t *testing.T) {
+	client := &Client{acks: make(map[string]*pendingAck)}
+	channel := &Channel{Name: "orders"}
+
+	for _, id := range []string{"1", "2", "3"} {
+		client.expectAck(channel, &Message{ID: id}, []byte(id))
+	}
+
+	// The first message was sent again since, the others never were
+	client.acks["1"].sent = time.Now().Add(time.Second)
+	client.acks["1"].attempts = 2
+	client.acks["3"].sent = time.Now().Add(-time.Second)
+
+	frames := client.dueAcks(time.Now().Add(time.Minute))
+
+	if len(frames) != 3 || string(frames[0]) != "1" || string(frames[1]) != "2" || string(frames[2]) != "3" {
+		t.Errorf("got %q, want them in the order first sent", frames)
+	}
+
+	if client.acks["1"].attempts != 3 || client.acks["2"].attempts != 2 {
+		t.Errorf("got attempts %d and %d, want them counted", client.acks["1"].attempts, client.acks["2"].attempts)
+	}
+}
+
+func TestDueAcksGivesUp(t *testing.T) {
+	server := newWebsocketServer(&App{Key: "key"}, newMemoryBroker(), "node", nil)
+	client := newTestRecipient(server)
+	client.acks = make(map[string]*pendingAck)
+
+	client.expectAck(&Channel{Name: "orders"}, &Message{ID: "1", Receipt: true, receiptTo: "sender"}, []byte("1"))
+	client.expectAck(&Channel{Name: "orders"}, &Message{ID: "2"}, []byte("2"))
+	client.acks["1"].attempts = maxDeliveryAttempts
+
+	frames := client.dueAcks(time.Now())
+
+	if len(frames) != 1 || string(frames[0]) != "2" {
+		t.Errorf("got %q, want only the message still tried", frames)
+	}
+
+	if _, ok := client.acks["1"]; ok {
+		t.Error("kept waiting for the ack of a message given up on")
+	}
+
+	select {
+
+	case envelope := <-server.direct:
+		var receipt DeliveryReceipt
+		json.Unmarshal(envelope.Message.Data, &receipt)
+
+		if envelope.Socket != "sender" || envelope.Message.Action != DeliveryFailedAction || receipt.ID != "1" {
+			t.Errorf("got %+v with %+v, want delivery_failed for message 1 to the sender", envelope, receipt)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("got no delivery_failed")
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultAppID is the ID of the app built from environment variables when no
+// APPS_FILE is configured.
+const DefaultAppID = "default"
+
+// App is a tenant of the server. Every app has its own credentials, webhook,
+// limits and WsServer, so channels never leak between apps.
+type App struct {
+	ID             string `json:"id"`
+	Key            string `json:"key"`
+	Secret         string `json:"secret"`
+	ServerKey      string `json:"server_key"`
+	WebhookURL     string `json:"webhook_url"`
+	MaxConnections int    `json:"max_connections"`
+	MaxBatchSize   int    `json:"max_batch_size"`
+	// ClientEvents allows members of private and presence channels to publish
+	// client- events, optionally only on channels matching ClientEventChannels.
+	ClientEvents        bool     `json:"client_events"`
+	ClientEventChannels []string `json:"client_event_channels"`
+	// HistorySize is the number of messages kept per channel for replay on
+	// join, optionally only on channels matching HistoryChannels. Messages
+	// older than HistoryMaxAge seconds are dropped. HistoryStore is memory or
+	// file, which logs to HistoryDir and keeps up to HistoryMaxBytes per channel.
+	HistorySize     int      `json:"history_size"`
+	HistoryMaxAge   int      `json:"history_max_age"`
+	HistoryChannels []string `json:"history_channels"`
+	HistoryStore    string   `json:"history_store"`
+	HistoryDir      string   `json:"history_dir"`
+	HistoryMaxBytes int64    `json:"history_max_bytes"`
+	// ResumeGracePeriod is how many seconds a dropped connection can be
+	// resumed for, keeping its channels and buffering its messages.
+	ResumeGracePeriod int `json:"resume_grace_period"`
+	// AckChannels are the channels whose messages clients must ack, sent
+	// again after AckTimeout seconds until they are. None by default.
+	AckChannels []string `json:"ack_channels"`
+	AckTimeout  int      `json:"ack_timeout"`
+	// RequestURL is the backend answering requests made without a channel.
+	// Requests fail with a timeout error after RequestTimeout seconds.
+	RequestURL     string `json:"request_url"`
+	RequestTimeout int    `json:"request_timeout"`
+	// MaxDataSize is the largest data a message can carry, in bytes of JSON.
+	MaxDataSize int `json:"max_data_size"`
+	server      *WsServer
+}
+
+// AppsConfig is the format of the file referenced by APPS_FILE.
+type AppsConfig struct {
+	Apps []*App `json:"apps"`
+}
+
+// loadApps reads the apps from APPS_FILE, or builds a single default app from
+// APP_KEY, APP_SECRET, SERVER_KEY, WEBHOOK_URL, MAX_BATCH_SIZE, CLIENT_EVENTS,
+// CLIENT_EVENT_CHANNELS, HISTORY_SIZE, HISTORY_MAX_AGE, HISTORY_CHANNELS,
+// HISTORY_STORE, HISTORY_DIR, HISTORY_MAX_BYTES, RESUME_GRACE_PERIOD,
+// ACK_CHANNELS, ACK_TIMEOUT, REQUEST_URL, REQUEST_TIMEOUT and MAX_DATA_SIZE.
+func loadApps() ([]*App, error) {
+	path := os.Getenv("APPS_FILE")
+
+	if len(path) == 0 {
+		app := &App{
+			ID:         DefaultAppID,
+			Key:        os.Getenv("APP_KEY"),
+			Secret:     os.Getenv("APP_SECRET"),
+			ServerKey:  os.Getenv("SERVER_KEY"),
+			WebhookURL: os.Getenv("WEBHOOK_URL"),
+		}
+
+		if len(app.ServerKey) == 0 {
+			app.ServerKey = os.Getenv("AUTH_TOKEN")
+		}
+
+		app.MaxBatchSize, _ = strconv.Atoi(os.Getenv("MAX_BATCH_SIZE"))
+		app.ClientEvents, _ = strconv.ParseBool(os.Getenv("CLIENT_EVENTS"))
+
+		if channels := os.Getenv("CLIENT_EVENT_CHANNELS"); len(channels) > 0 {
+			app.ClientEventChannels = strings.Split(channels, ",")
+		}
+
+		app.HistorySize, _ = strconv.Atoi(os.Getenv("HISTORY_SIZE"))
+		app.HistoryMaxAge, _ = strconv.Atoi(os.Getenv("HISTORY_MAX_AGE"))
+
+		if channels := os.Getenv("HISTORY_CHANNELS"); len(channels) > 0 {
+			app.HistoryChannels = strings.Split(channels, ",")
+		}
+
+		app.HistoryStore = os.Getenv("HISTORY_STORE")
+		app.HistoryDir = os.Getenv("HISTORY_DIR")
+		app.HistoryMaxBytes, _ = strconv.ParseInt(os.Getenv("HISTORY_MAX_BYTES"), 10, 64)
+		app.ResumeGracePeriod, _ = strconv.Atoi(os.Getenv("RESUME_GRACE_PERIOD"))
+
+		if channels := os.Getenv("ACK_CHANNELS"); len(channels) > 0 {
+			app.AckChannels = strings.Split(channels, ",")
+		}
+
+		app.AckTimeout, _ = strconv.Atoi(os.Getenv("ACK_TIMEOUT"))
+		app.RequestURL = os.Getenv("REQUEST_URL")
+		app.RequestTimeout, _ = strconv.Atoi(os.Getenv("REQUEST_TIMEOUT"))
+		app.MaxDataSize, _ = strconv.Atoi(os.Getenv("MAX_DATA_SIZE"))
+
+		return []*App{app}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config AppsConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	if len(config.Apps) == 0 {
+		return nil, errors.New("no apps configured in " + path)
+	}
+
+	keys := make(map[string]bool)
+
+	for _, app := range config.Apps {
+		if len(app.Key) == 0 || len(app.Secret) == 0 {
+			return nil, fmt.Errorf("app %q requires a key and a secret", app.ID)
+		}
+
+		if keys[app.Key] {
+			return nil, fmt.Errorf("app key %q is used more than once", app.Key)
+		}
+		keys[app.Key] = true
+
+		if len(app.ServerKey) == 0 {
+			app.ServerKey = app.Secret
+		}
+	}
+
+	return config.Apps, nil
+}
+
+// maxBatchSize returns the maximum number of events allowed in one batch.
+func (app *App) maxBatchSize() int {
+	if app.MaxBatchSize > 0 {
+		return app.MaxBatchSize
+	}
+
+	return defaultMaxBatchSize
+}
+
+// clientEventsEnabled reports whether client events may be published on the
+// named channel.
+func (app *App) clientEventsEnabled(channelName string) bool {
+	if !app.ClientEvents {
+		return false
+	}
+
+	return matchChannelPatterns(app.ClientEventChannels, channelName)
+}
+
+// keepsHistory reports whether messages of the named channel are stored for
+// replay.
+func (app *App) keepsHistory(channelName string) bool {
+	return app.HistorySize > 0 && matchChannelPatterns(app.HistoryChannels, channelName)
+}
+
+// requiresAck reports whether clients must ack the messages of the named
+// channel.
+func (app *App) requiresAck(channelName string) bool {
+	return len(app.AckChannels) > 0 && matchChannelPatterns(app.AckChannels, channelName)
+}
+
+// ackTimeout returns how long clients have to ack a message.
+func (app *App) ackTimeout() time.Duration {
+	if app.AckTimeout > 0 {
+		return time.Duration(app.AckTimeout) * time.Second
+	}
+
+	return defaultAckTimeout
+}
+
+// requestTimeout returns how long a request waits for a reply.
+func (app *App) requestTimeout() time.Duration {
+	if app.RequestTimeout > 0 {
+		return time.Duration(app.RequestTimeout) * time.Second
+	}
+
+	return defaultRequestTimeout
+}
+
+// maxDataSize returns the largest data a message can carry. Data never takes
+// more than defaultMaxDataSize, so messages fit in a frame.
+func (app *App) maxDataSize() int {
+	if app.MaxDataSize > 0 && app.MaxDataSize < defaultMaxDataSize {
+		return app.MaxDataSize
+	}
+
+	return defaultMaxDataSize
+}
+
+// matchChannelPatterns reports whether the channel name matches one of the
+// patterns. An empty list matches every channel.
+func matchChannelPatterns(patterns []string, channelName string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, channelName); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// appEndpoints are the endpoints every app serves, under /apps/{key}/ and,
+// when only one app is configured, at the root.
+var appEndpoints = []string{"ws", "sse", "events", "batch_events", "reply", "send_to_user", "send_to_socket"}
+
+// serveApps routes /apps/{key}/{endpoint} to the app with that key. Tokens for
+// its ws and sse endpoints must name the app key in their aud.
+func serveApps(verifier *JWTVerifier, apps map[string]*App, w http.ResponseWriter, r *http.Request) {
+	key, endpoint, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/apps/"), "/")
+
+	app, ok := apps[key]
+	if !ok || len(key) == 0 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	serveApp(verifier, app, app, endpoint, w, r)
+}
+
+// serveApp serves one of the app's endpoints. When audience is set,
+// connection tokens must name its key in their aud.
+func serveApp(verifier *JWTVerifier, app *App, audience *App, endpoint string, w http.ResponseWriter, r *http.Request) {
+	switch endpoint {
+
+	case "ws":
+		middleware(verifier, audience, func(w http.ResponseWriter, r *http.Request) {
+			serveWs(app.server, w, r)
+		})(w, r)
+
+	case "sse":
+		middleware(verifier, audience, func(w http.ResponseWriter, r *http.Request) {
+			serveSSE(app.server, w, r)
+		})(w, r)
+
+	case "events":
+		apiMiddleware(app, func(w http.ResponseWriter, r *http.Request) {
+			serveEvents(app.server, w, r)
+		})(w, r)
+
+	case "batch_events":
+		apiMiddleware(app, func(w http.ResponseWriter, r *http.Request) {
+			serveBatchEvents(app.server, w, r)
+		})(w, r)
+
+	case "reply":
+		apiMiddleware(app, func(w http.ResponseWriter, r *http.Request) {
+			serveReply(app.server, w, r)
+		})(w, r)
+
+	case "send_to_user":
+		apiMiddleware(app, func(w http.ResponseWriter, r *http.Request) {
+			serveSendToUser(app.server, w, r)
+		})(w, r)
+
+	case "send_to_socket":
+		apiMiddleware(app, func(w http.ResponseWriter, r *http.Request) {
+			serveSendToSocket(app.server, w, r)
+		})(w, r)
+
+	default:
+		log.Printf("Unknown app endpoint %s", r.URL.Path)
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
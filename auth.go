@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+const PrivateChannelPrefix = "private-"
+const PresenceChannelPrefix = "presence-"
+
+var (
+	errAuthNotConfigured  = errors.New("channel authorization is not configured")
+	errMissingAuth        = errors.New("auth is required for private and presence channels")
+	errInvalidAuthKey     = errors.New("auth key does not match the application key")
+	errInvalidSignature   = errors.New("invalid auth signature")
+	errMissingChannelData = errors.New("channel_data is required for presence channels")
+	errInvalidPrivateName = errors.New("private channel names must start with private- or presence-")
+)
+
+// isPrivateChannelName reports whether joining the channel requires a signed auth.
+func isPrivateChannelName(name string) bool {
+	return strings.HasPrefix(name, PrivateChannelPrefix) || isPresenceChannelName(name)
+}
+
+func isPresenceChannelName(name string) bool {
+	return strings.HasPrefix(name, PresenceChannelPrefix)
+}
+
+// channelSignature returns the hex encoded HMAC-SHA256 of
+// socket_id:channel_name, with :channel_data appended for presence channels.
+func channelSignature(secret string, socketId string, channelName string, channelData string) string {
+	payload := socketId + ":" + channelName
+	if len(channelData) > 0 {
+		payload += ":" + channelData
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyChannelAuth checks a Pusher style auth string of the form
+// "app_key:signature" against the app's key and secret.
+func verifyChannelAuth(app *App, auth string, socketId string, channelName string, channelData string) error {
+	appKey := app.Key
+	appSecret := app.Secret
+
+	if len(appKey) == 0 || len(appSecret) == 0 {
+		return errAuthNotConfigured
+	}
+
+	if len(auth) == 0 {
+		return errMissingAuth
+	}
+
+	if isPresenceChannelName(channelName) && len(channelData) == 0 {
+		return errMissingChannelData
+	}
+
+	key, signature, found := strings.Cut(auth, ":")
+
+	if !found || !hmac.Equal([]byte(key), []byte(appKey)) {
+		return errInvalidAuthKey
+	}
+
+	expected := channelSignature(appSecret, socketId, channelName, channelData)
+
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errInvalidSignature
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestVerifyChannelAuth(t *testing.T) {
+	app := &App{Key: "key", Secret: "secret"}
+
+	const socketId = "socket"
+	const channelData = `{"user_id":"1"}`
+
+	privateAuth := "key:" + channelSignature("secret", socketId, "private-a", "")
+	presenceAuth := "key:" + channelSignature("secret", socketId, "presence-a", channelData)
+
+	tests := []struct {
+		name        string
+		app         *App
+		auth        string
+		channel     string
+		channelData string
+		err         error
+	}{
+		{"private", app, privateAuth, "private-a", "", nil},
+		{"presence", app, presenceAuth, "presence-a", channelData, nil},
+		{"not configured", &App{Key: "key"}, privateAuth, "private-a", "", errAuthNotConfigured},
+		{"missing auth", app, "", "private-a", "", errMissingAuth},
+		{"missing channel data", app, presenceAuth, "presence-a", "", errMissingChannelData},
+		{"no separator", app, "key", "private-a", "", errInvalidAuthKey},
+		{"wrong key", app, "other:" + channelSignature("secret", socketId, "private-a", ""), "private-a", "", errInvalidAuthKey},
+		{"wrong secret", app, "key:" + channelSignature("other", socketId, "private-a", ""), "private-a", "", errInvalidSignature},
+		{"other channel", app, privateAuth, "private-b", "", errInvalidSignature},
+		{"other channel data", app, presenceAuth, "presence-a", `{"user_id":"2"}`, errInvalidSignature},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := verifyChannelAuth(test.app, test.auth, socketId, test.channel, test.channelData)
+
+			if err != test.err {
+				t.Errorf("got %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestVerifyChannelAuthOtherSocket(t *testing.T) {
+	app := &App{Key: "key", Secret: "secret"}
+	auth := "key:" + channelSignature("secret", "socket", "private-a", "")
+
+	if err := verifyChannelAuth(app, auth, "other", "private-a", ""); err != errInvalidSignature {
+		t.Errorf("got %v, want %v", err, errInvalidSignature)
+	}
+}
+
+func TestChannelSignature(t *testing.T) {
+	// Pusher's documented example
+	got := channelSignature("7ad3773142a6692b25b8", "1234.1234", "private-foobar", "")
+	want := "58df8b0c36d6982b82c3ecf6b4662e34fe8c25bba48f5369f135bf843651c3a4"
+
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestIsPrivateChannelName(t *testing.T) {
+	tests := []struct {
+		name     string
+		private  bool
+		presence bool
+	}{
+		{"public", false, false},
+		{"private-a", true, false},
+		{"presence-a", true, true},
+		{"a-private-", false, false},
+	}
+
+	for _, test := range tests {
+		if got := isPrivateChannelName(test.name); got != test.private {
+			t.Errorf("isPrivateChannelName(%q) = %v, want %v", test.name, got, test.private)
+		}
+
+		if got := isPresenceChannelName(test.name); got != test.presence {
+			t.Errorf("isPresenceChannelName(%q) = %v, want %v", test.name, got, test.presence)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+const BrokerMessage = "message"
+const BrokerMemberAdded = "member_added"
+const BrokerMemberRemoved = "member_removed"
+const BrokerPresenceSync = "presence_sync"
+const BrokerNodeJoined = "node_joined"
+const BrokerNodeLeft = "node_left"
+const BrokerHeartbeat = "heartbeat"
+const BrokerSocket = "socket"
+const BrokerUser = "user"
+
+var errUnknownBroker = errors.New("unknown BROKER, expected memory, redis or cluster")
+
+// Broker carries channel and server-wide broadcasts between gosocks nodes.
+// Every node delivers to its own clients directly and publishes an envelope
+// for the other nodes, ignoring its own envelopes when they come back.
+type Broker interface {
+	// Publish sends payload to the subscribers of topic on every node and
+	// returns how many subscriptions received it.
+	Publish(topic string, payload []byte) (int, error)
+
+	// Subscribe registers the handler for payloads published to topic.
+	Subscribe(topic string, handler func(payload []byte)) error
+
+	Unsubscribe(topic string) error
+
+	Close() error
+}
+
+// BrokerEnvelope is what nodes exchange through the Broker. Kind is one of
+// the Broker* constants; Message is set for messages, Member for presence,
+// Socket for messages to a single socket, User for messages to every socket
+// of a user and Started, the node's start time, for heartbeats.
+type BrokerEnvelope struct {
+	Node    string   `json:"node"`
+	Kind    string   `json:"kind"`
+	Message *Message `json:"message,omitempty"`
+	Exclude string   `json:"exclude,omitempty"`
+	Receipt string   `json:"receipt,omitempty"`
+	Member  *Member  `json:"member,omitempty"`
+	Socket  string   `json:"socket,omitempty"`
+	User    string   `json:"user,omitempty"`
+	Started int64    `json:"started,omitempty"`
+	// leader is set on the node_left envelopes of the node that sends the
+	// webhooks for the users of the node that left. It never leaves the node.
+	leader bool
+}
+
+// decodeEnvelope reads a published payload, returning nil for envelopes this
+// node published itself.
+func decodeEnvelope(nodeId string, payload []byte) *BrokerEnvelope {
+	var envelope BrokerEnvelope
+
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		log.Printf("Error on unmarshal broker envelope %s", err)
+		return nil
+	}
+
+	if envelope.Node == nodeId {
+		return nil
+	}
+
+	return &envelope
+}
+
+// receiveEnvelope handles payloads on the server topic.
+func (server *WsServer) receiveEnvelope(payload []byte) {
+	envelope := decodeEnvelope(server.nodeId, payload)
+
+	if envelope == nil || envelope.Message == nil {
+		return
+	}
+
+	switch envelope.Kind {
+
+	case BrokerMessage:
+		server.broadcast <- envelope.Message.encode()
+
+	case BrokerSocket, BrokerUser:
+		server.direct <- envelope
+	}
+}
+
+// receiveEnvelope handles payloads on the channel topic.
+func (channel *Channel) receiveEnvelope(payload []byte) {
+	if envelope := decodeEnvelope(channel.server.nodeId, payload); envelope != nil {
+		channel.remote <- envelope
+	}
+}
+
+// handleEnvelope applies an envelope published by another node to the channel.
+func (channel *Channel) handleEnvelope(envelope *BrokerEnvelope) {
+	// Messages are kept in history even while there is nobody to send them to
+	if envelope.Kind == BrokerMessage {
+		if envelope.Message == nil {
+			return
+		}
+
+		message := envelope.Message
+		message.Target = channel
+		message.exclude = envelope.Exclude
+		message.receiptTo = envelope.Receipt
+
+		channel.broadcastMessage(message)
+		return
+	}
+
+	switch envelope.Kind {
+
+	case BrokerMemberAdded:
+		if envelope.Member != nil {
+			channel.addRemoteMember(envelope.Node, envelope.Member)
+		}
+
+	case BrokerMemberRemoved:
+		if envelope.Member != nil {
+			channel.removeRemoteMember(envelope.Node, envelope.Member.UserID)
+		}
+
+	case BrokerPresenceSync:
+		channel.syncPresence()
+
+	case BrokerNodeJoined:
+		channel.requestPresence()
+
+	case BrokerNodeLeft:
+		channel.removeNode(envelope.Node, envelope.leader)
+	}
+}
+
+// newBroker creates the Broker selected by BROKER, defaulting to memory.
+func newBroker(nodeId string) (Broker, error) {
+	switch os.Getenv("BROKER") {
+
+	case "", "memory":
+		return newMemoryBroker(), nil
+
+	case "redis":
+		return newRedisBroker(os.Getenv("REDIS_URL"))
+
+	case "cluster":
+		var peers []string
+		if list := os.Getenv("CLUSTER_PEERS"); len(list) > 0 {
+			peers = strings.Split(list, ",")
+		}
+
+		return newClusterBroker(nodeId, os.Getenv("CLUSTER_LISTEN"), os.Getenv("CLUSTER_SECRET"), peers)
+	}
+
+	return nil, errUnknownBroker
+}
+
+// MemoryBroker delivers payloads to subscribers in the same process. It is
+// the single node setup, where nothing has to leave the process.
+type MemoryBroker struct {
+	handlers map[string]func(payload []byte)
+	mu       sync.RWMutex
+}
+
+func newMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		handlers: make(map[string]func(payload []byte)),
+	}
+}
+
+func (broker *MemoryBroker) Publish(topic string, payload []byte) (int, error) {
+	broker.mu.RLock()
+	handler, ok := broker.handlers[topic]
+	broker.mu.RUnlock()
+
+	if !ok {
+		return 0, nil
+	}
+
+	handler(payload)
+
+	return 1, nil
+}
+
+func (broker *MemoryBroker) Subscribe(topic string, handler func(payload []byte)) error {
+	broker.mu.Lock()
+	broker.handlers[topic] = handler
+	broker.mu.Unlock()
+
+	return nil
+}
+
+func (broker *MemoryBroker) Unsubscribe(topic string) error {
+	broker.mu.Lock()
+	delete(broker.handlers, topic)
+	broker.mu.Unlock()
+
+	return nil
+}
+
+func (broker *MemoryBroker) Close() error {
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"time"
 
 	"github.com/google/uuid"
@@ -9,24 +10,59 @@ import (
 type Channel struct {
 	ID          uuid.UUID `json:"id"`
 	Name        string    `json:"name"`
+	server      *WsServer
 	clients     map[*Client]bool
-	subscribe   chan *Client
+	members     map[string]*Member
+	subscribe   chan *Subscription
 	unsubscribe chan *Client
 	broadcast   chan *Message
-	Private     bool `json:"private"`
+	remote      chan *BrokerEnvelope
+	// replay sends history to a client already in the channel.
+	replay chan *Subscription
+	// sequence is the number of the last message broadcast in the channel.
+	sequence uint64
+	// history is set when the channel's messages are kept in the history store.
+	history bool
+	// acks is set when clients must ack the channel's messages.
+	acks    bool
+	Private bool `json:"private"`
 }
 
-// NewChannel creates a new Channel
-func NewChannel(name string, private bool) *Channel {
-	return &Channel{
+// NewChannel creates a new Channel, numbering its messages after sequence
+func NewChannel(server *WsServer, name string, private bool, sequence uint64) *Channel {
+	channel := &Channel{
 		ID:          uuid.New(),
 		Name:        name,
+		server:      server,
 		clients:     make(map[*Client]bool),
-		subscribe:   make(chan *Client),
+		members:     make(map[string]*Member),
+		subscribe:   make(chan *Subscription),
 		unsubscribe: make(chan *Client),
 		broadcast:   make(chan *Message),
+		remote:      make(chan *BrokerEnvelope),
+		replay:      make(chan *Subscription),
+		sequence:    sequence,
+		history:     server.app.keepsHistory(name),
+		acks:        server.app.requiresAck(name),
 		Private:     private,
 	}
+
+	return channel
+}
+
+// lastSequence returns the sequence number of the last message stored for a
+// channel, so a channel created again keeps numbering after it.
+func (server *WsServer) lastSequence(name string) uint64 {
+	if !server.app.keepsHistory(name) {
+		return 0
+	}
+
+	sequence, err := server.history.LastSequence(name)
+	if err != nil {
+		log.Printf("Error on reading history for channel %s %s", name, err)
+	}
+
+	return sequence
 }
 
 // RunChannel runs our channel, accepting various requests
@@ -34,26 +70,192 @@ func (channel *Channel) RunChannel() {
 	for {
 		select {
 
-		case client := <-channel.subscribe:
-			channel.subscribeClientInChannel(client)
+		case subscription := <-channel.subscribe:
+			channel.subscribeClientInChannel(subscription)
 
 		case client := <-channel.unsubscribe:
 			channel.unsubscribeClientInChannel(client)
 
 		case message := <-channel.broadcast:
-			channel.broadcastToClientsInChannel(message.encode())
+			channel.broadcastMessage(message)
+
+		case envelope := <-channel.remote:
+			channel.handleEnvelope(envelope)
+
+		case replay := <-channel.replay:
+			channel.replayHistory(replay.client, replay.history)
 		}
 	}
 }
 
-func (channel *Channel) subscribeClientInChannel(client *Client) {
-	channel.notifyClientJoined(client)
-	channel.clients[client] = true
+func (channel *Channel) subscribeClientInChannel(subscription *Subscription) {
+	client := subscription.client
+
+	if len(channel.clients) == 0 {
+		channel.subscribeTopic()
+	}
+
+	if subscription.member != nil {
+		channel.subscribeMemberInChannel(client, subscription.member)
+	} else {
+		channel.notifyClientJoined(client)
+		channel.clients[client] = true
+	}
+
+	if subscription.history != nil {
+		channel.replayHistory(client, subscription.history)
+	}
 }
 
 func (channel *Channel) unsubscribeClientInChannel(client *Client) {
-	channel.notifyClientLeft(client)
+	if member := channel.findMember(client); member != nil {
+		channel.unsubscribeMemberInChannel(client, member)
+	} else {
+		// Remove the client first, its send channel may already be closed
+		delete(channel.clients, client)
+		channel.notifyClientLeft(client)
+	}
+
+	if len(channel.clients) == 0 {
+		channel.unsubscribeTopic()
+	}
+}
+
+// subscribeTopic starts receiving the channel's broadcasts from other nodes,
+// once the channel has a local client. Presence channels ask the other nodes
+// who is already present.
+func (channel *Channel) subscribeTopic() {
+	topic := channel.server.channelTopic(channel.Name)
+
+	if err := channel.server.broker.Subscribe(topic, channel.receiveEnvelope); err != nil {
+		log.Printf("Error on subscribing to broker %s", err)
+	}
+
+	channel.requestPresence()
+}
+
+// unsubscribeTopic stops receiving broadcasts once the last local client has
+// left. Channels keeping history stay subscribed, so the next client to join
+// can replay what was sent meanwhile, and so do presence channels, so this
+// node can still clean up after the users of a node that leaves.
+func (channel *Channel) unsubscribeTopic() {
+	if channel.history || isPresenceChannelName(channel.Name) {
+		return
+	}
+
+	if err := channel.server.broker.Unsubscribe(channel.server.channelTopic(channel.Name)); err != nil {
+		log.Printf("Error on unsubscribing from broker %s", err)
+	}
+}
+
+// subscribeMemberInChannel adds a client to a presence channel. Members are
+// tracked per user across every node, so member_added is only sent for a
+// user's first connection.
+func (channel *Channel) subscribeMemberInChannel(client *Client, joining *Member) {
+	member, ok := channel.members[joining.UserID]
+
+	if !ok {
+		member = newMember(joining)
+
+		channel.notifyMemberAdded(member)
+		channel.members[member.UserID] = member
+		go webhook(client, MemberAddedAction)
+	}
+
+	// Other nodes only need to know about the user's first connection here
+	if len(member.clients) == 0 {
+		channel.publishPresence(BrokerMemberAdded, member)
+	}
+
+	member.clients[client] = true
+	channel.clients[client] = true
+
+	message := &Message{
+		Action:    SubscriptionSucceededAction,
+		Event:     SubscriptionSucceededAction,
+		Name:      channel.Name,
+		Data:      channel.presenceData(),
+		Target:    channel,
+		Timestamp: time.Now().Unix(),
+	}
+
+	client.send <- message.encode()
+}
+
+// unsubscribeMemberInChannel removes a client from a presence channel, sending
+// member_removed once the user's last connection on any node has left.
+func (channel *Channel) unsubscribeMemberInChannel(client *Client, member *Member) {
+	delete(member.clients, client)
 	delete(channel.clients, client)
+
+	if len(member.clients) > 0 {
+		return
+	}
+
+	channel.publishPresence(BrokerMemberRemoved, member)
+
+	if len(member.nodes) == 0 {
+		delete(channel.members, member.UserID)
+		channel.notifyMemberRemoved(member)
+		go webhook(client, MemberRemovedAction)
+	}
+}
+
+// broadcastMessage numbers a message and sends it to every client in the
+// channel except the excluded socket, keeping it in the channel's history.
+func (channel *Channel) broadcastMessage(message *Message) {
+	// Requests are only for the clients around when they are made, so they
+	// are not numbered, stored or acked
+	request := message.Action == RequestAction
+
+	if !request {
+		channel.sequence++
+		message.Sequence = channel.sequence
+	}
+
+	if channel.history && !request {
+		if err := channel.server.history.Append(channel.Name, message); err != nil {
+			log.Printf("Error on storing history for channel %s %s", channel.Name, err)
+		}
+	}
+
+	encoded := message.encode()
+
+	for client := range channel.clients {
+		if len(message.exclude) > 0 && client.GetId() == message.exclude {
+			continue
+		}
+
+		if channel.acks && !request {
+			client.expectAck(channel, message, encoded)
+		}
+
+		if request {
+			client.receiveRequest(message)
+		}
+
+		client.send <- encoded
+	}
+}
+
+// replayHistory sends a joining client the messages it asked for, oldest first.
+func (channel *Channel) replayHistory(client *Client, request *HistoryRequest) {
+	if !channel.history {
+		return
+	}
+
+	messages, err := channel.server.history.Read(channel.Name, request)
+	if err != nil {
+		log.Printf("Error on reading history for channel %s %s", channel.Name, err)
+		return
+	}
+
+	for _, message := range messages {
+		replayed := *message
+		replayed.Target = channel
+
+		client.send <- replayed.encode()
+	}
 }
 
 func (channel *Channel) broadcastToClientsInChannel(message []byte) {
@@ -100,6 +302,32 @@ func (channel *Channel) notifyClientLeft(client *Client) {
 	channel.broadcastToClientsInChannel(message.encode())
 }
 
+func (channel *Channel) notifyMemberAdded(member *Member) {
+	message := &Message{
+		Action:    MemberAddedAction,
+		Name:      channel.Name,
+		Event:     MemberAddedAction,
+		Data:      member.encode(),
+		Target:    channel,
+		Timestamp: time.Now().Unix(),
+	}
+
+	channel.broadcastToClientsInChannel(message.encode())
+}
+
+func (channel *Channel) notifyMemberRemoved(member *Member) {
+	message := &Message{
+		Action:    MemberRemovedAction,
+		Name:      channel.Name,
+		Event:     MemberRemovedAction,
+		Data:      member.encode(),
+		Target:    channel,
+		Timestamp: time.Now().Unix(),
+	}
+
+	channel.broadcastToClientsInChannel(message.encode())
+}
+
 func (channel *Channel) GetId() string {
 	return channel.ID.String()
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -24,13 +25,11 @@ const (
 	maxMessageSize = 10000
 )
 
-var (
-	plus = []byte{'+'}
-)
-
 var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+	ReadBufferSize:    1024,
+	WriteBufferSize:   1024,
+	EnableCompression: true,
+	Subprotocols:      []string{ProtobufSubprotocol, MsgpackSubprotocol, JSONBatchSubprotocol, JSONSubprotocol},
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
@@ -40,25 +39,74 @@ var upgrader = websocket.Upgrader{
 type Client struct {
 	// The actual websocket connection.
 	conn     *websocket.Conn
+	features Features
+	codec    Codec
 	wsServer *WsServer
 	send     chan []byte
 	ID       uuid.UUID `json:"id"`
+	UserID   string    `json:"-"`
+	claims   *Claims
+	grants   []ChannelGrant
 	channels map[*Channel]bool
+	// members holds the presence identity used in each presence channel.
+	members map[*Channel]*Member
+	// resumeToken identifies the session when resume is enabled. stop ends
+	// the pumps of the current connection and stopped is closed once the
+	// writePump returned; resume hands over a new connection.
+	resumeToken string
+	// streamToken authenticates the frames posted to an event stream.
+	streamToken string
+	stop        chan struct{}
+	stopped     chan struct{}
+	resume      chan *Resumption
+	// acks are the messages of ack channels waiting for an ack, by id.
+	// ackOrder numbers them in the order they were first sent.
+	acks     map[string]*pendingAck
+	ackOrder uint64
+	acksMu   sync.Mutex
+	// requests are the requests waiting for a reply, by correlation id.
+	requests   map[string]*time.Timer
+	requestsMu sync.Mutex
+	// received are the requests sent to the client it may still reply to.
+	received   map[receivedRequest]*time.Timer
+	receivedMu sync.Mutex
 }
 
-func newClient(conn *websocket.Conn, wsServer *WsServer) *Client {
-	return &Client{
+func newClient(conn *websocket.Conn, wsServer *WsServer, claims *Claims) *Client {
+	client := &Client{
 		ID:       uuid.New(),
 		conn:     conn,
 		wsServer: wsServer,
 		send:     make(chan []byte, 256),
+		claims:   claims,
+		grants:   parseChannelGrants(claims),
 		channels: make(map[*Channel]bool),
+		members:  make(map[*Channel]*Member),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		resume:   make(chan *Resumption),
+		acks:     make(map[string]*pendingAck),
+		requests: make(map[string]*time.Timer),
+		received: make(map[receivedRequest]*time.Timer),
+	}
+
+	if claims != nil {
+		client.UserID = claims.Subject
 	}
+
+	return client
 }
 
 func (client *Client) readPump() {
+	// A connection closed on purpose is not resumed
+	closed := false
+
 	defer func() {
-		client.disconnect()
+		if client.wsServer.app.ResumeGracePeriod > 0 && !closed {
+			client.detach()
+		} else {
+			client.disconnect()
+		}
 	}()
 
 	client.conn.SetReadLimit(maxMessageSize)
@@ -67,14 +115,22 @@ func (client *Client) readPump() {
 
 	// Start endless read loop, waiting for messages from client
 	for {
-		_, jsonMessage, err := client.conn.ReadMessage()
+		_, frame, err := client.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("unexpected close error: %v", err)
 			}
+			closed = websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
 			break
 		}
 
+		jsonMessage, err := client.codec.Decode(frame)
+		if err != nil {
+			log.Printf("Error on decoding %s message %s", client.codec.Name(), err)
+			client.sendError("", ErrorCodeBadRequest, err.Error())
+			continue
+		}
+
 		client.handleNewMessage(jsonMessage)
 	}
 
@@ -83,9 +139,20 @@ func (client *Client) readPump() {
 func (client *Client) writePump() {
 	ticker := time.NewTicker(pingPeriod)
 
+	// Only apps with ack channels have messages to send again
+	var redeliver <-chan time.Time
+
+	if len(client.wsServer.app.AckChannels) > 0 {
+		ackTicker := time.NewTicker(ackCheckPeriod)
+		defer ackTicker.Stop()
+
+		redeliver = ackTicker.C
+	}
+
 	defer func() {
 		ticker.Stop()
 		client.conn.Close()
+		close(client.stopped)
 	}()
 
 	for {
@@ -99,22 +166,18 @@ func (client *Client) writePump() {
 				return
 			}
 
-			w, err := client.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				log.Printf("write-pump error on next writer %s", err)
-				return
-			}
-			w.Write(message)
+			messages := [][]byte{message}
 
-			// Attach queued chat messages to the current websocket message.
-			n := len(client.send)
-			for i := 0; i < n; i++ {
-				w.Write(plus)
-				w.Write(<-client.send)
+			// Batch the queued messages with the current one, if negotiated
+			if client.features.Batching {
+				n := len(client.send)
+				for i := 0; i < n; i++ {
+					messages = append(messages, <-client.send)
+				}
 			}
 
-			if err := w.Close(); err != nil {
-				log.Printf("write-pump error on close %s", err)
+			if err := client.writeMessages(messages); err != nil {
+				log.Printf("write-pump error on write %s", err)
 				return
 			}
 		case <-ticker.C:
@@ -123,30 +186,71 @@ func (client *Client) writePump() {
 				log.Printf("write-pump error on write %s", err)
 				return
 			}
+
+		case <-redeliver:
+			if err := client.writeMessages(client.dueAcks(time.Now().Add(-client.wsServer.app.ackTimeout()))); err != nil {
+				log.Printf("write-pump error on redelivery %s", err)
+				return
+			}
+
+		case <-client.stop:
+			return
 		}
 	}
 }
 
 func (client *Client) disconnect() {
+	client.wsServer.releaseConnection()
 	client.wsServer.unsubscribe <- client
 	for channel := range client.channels {
 		channel.unsubscribe <- client
 	}
+	client.cancelRequests()
 	close(client.send)
-	client.conn.Close()
+
+	// Event streams have no websocket
+	if client.conn != nil {
+		client.conn.Close()
+	}
 }
 
 // ServeWs handles websocket requests from clients requests.
 func serveWs(wsServer *WsServer, w http.ResponseWriter, r *http.Request) {
 
+	if !wsServer.acquireConnection() {
+		log.Printf("Connection limit reached for app %s", wsServer.app.ID)
+		http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 
 	if err != nil {
+		wsServer.releaseConnection()
 		log.Println(err)
 		return
 	}
 
-	client := newClient(conn, wsServer)
+	claims, _ := r.Context().Value(claimsContextKey).(*Claims)
+	features := negotiatedFeatures(wsServer.app, r, conn)
+
+	if token := r.URL.Query().Get("resume_token"); features.Resume && len(token) > 0 {
+		if client := wsServer.takeSession(token, claims); client != nil {
+			// The session still holds its connection slot
+			wsServer.releaseConnection()
+			client.resume <- &Resumption{conn: conn, features: features}
+			return
+		}
+
+		log.Printf("Unknown or expired resume token, starting a new session")
+	}
+
+	client := newClient(conn, wsServer, claims)
+	client.features = features
+	client.codec = codecFor(conn.Subprotocol())
+
+	// Queue the handshake before subscribing so it is always the first frame
+	client.notifyConnectionEstablished(features)
 
 	go client.writePump()
 	go client.readPump()
@@ -160,49 +264,114 @@ func (client *Client) handleNewMessage(jsonMessage []byte) {
 
 	if err := json.Unmarshal(jsonMessage, &message); err != nil {
 		log.Printf("Error on unmarshal JSON message %s", err)
-		webhook(client.ID.String(), ChannelUnexpectedError)
+		webhook(client, ChannelUnexpectedError)
 		return
 	}
 
 	message.Sender = client
 
-	log.Printf("handleNewMessage: %v", message)
+	log.Printf("handleNewMessage: %s %s", message.Action, message.Name)
+
+	// Frames of binary codecs can decode to more JSON than they took
+	if len(message.Data) > client.wsServer.app.maxDataSize() {
+		client.sendError(message.Name, ErrorCodeBadRequest, errDataTooLarge.Error())
+		return
+	}
 
 	switch message.Action {
 
 	case SendMessageAction:
-		webhook(client.ID.String(), SendMessageAction)
+		webhook(client, SendMessageAction)
 		client.handleSendMessage(&message)
 
 	case JoinChannelAction:
-		webhook(client.ID.String(), JoinChannelAction)
+		webhook(client, JoinChannelAction)
 		client.joinChannel(message)
 
 	case LeaveChannelAction:
-		webhook(client.ID.String(), LeaveChannelAction)
+		webhook(client, LeaveChannelAction)
 		client.handleLeaveChannelMessage(message)
 
 	case JoinChannelPrivateAction:
-		webhook(client.ID.String(), JoinChannelPrivateAction)
-		message.Sender = nil
+		webhook(client, JoinChannelPrivateAction)
 		client.joinChannel(message)
+
+	case HistoryAction:
+		client.handleHistoryMessage(message)
+
+	case AckAction:
+		client.handleAck(message)
+
+	case RequestAction:
+		client.handleRequest(&message)
+
+	case ReplyAction:
+		client.handleReplyMessage(&message)
+
+	case SendToUserAction, SendToSocketAction:
+		client.handleDirectMessage(&message)
 	default:
 		log.Printf("Unknown action %s", message.Action)
 	}
 }
 
 func (client *Client) handleSendMessage(message *Message) {
-	if channel := client.wsServer.findChannelByName(message.Name); channel != nil {
-		if !channel.Private {
-			log.Printf("Blocked sending message from a non private channel %s", channel.Name)
-			return
-		}
+	// Sockets may only publish client events, everything else comes from the server
+	if !isClientEvent(message.Event) {
+		client.sendError(message.Name, ErrorCodeBadRequest, errNotClientEvent.Error())
+		return
+	}
 
-		message.Target = channel
-		message.Timestamp = time.Now().Unix()
+	channel, code, err := client.authorizePublish(message.Name)
 
-		channel.broadcast <- message
+	if err != nil {
+		client.sendError(message.Name, code, err.Error())
+		return
 	}
+
+	message.Timestamp = time.Now().Unix()
+	message.UserID = client.UserID
+
+	// Sockets only get the receipts of their own messages
+	if message.Receipt {
+		message.receiptTo = client.GetId()
+	}
+
+	if member, ok := client.members[channel]; ok {
+		message.UserID = member.UserID
+	}
+
+	// Client events are not echoed back to the sender
+	message.exclude = client.GetId()
+
+	if err := client.wsServer.publish(channel.Name, message); err != nil {
+		client.sendError(channel.Name, ErrorCodeBadRequest, err.Error())
+	}
+}
+
+// authorizePublish checks that the client may publish to the named channel,
+// returning the channel or the error code and error to send back.
+func (client *Client) authorizePublish(name string) (*Channel, int, error) {
+	if !client.isGranted(name, GrantPublish) {
+		return nil, ErrorCodeForbidden, errPublishDenied
+	}
+
+	channel := client.wsServer.findChannelByName(name)
+
+	if channel == nil || !client.isInChannel(channel) {
+		return nil, ErrorCodeForbidden, errClientEventNotSubscribed
+	}
+
+	if !channel.Private {
+		log.Printf("Blocked client event on a non private channel %s", channel.Name)
+		return nil, ErrorCodeForbidden, errClientEventNotPrivate
+	}
+
+	if !client.wsServer.app.clientEventsEnabled(channel.Name) {
+		return nil, ErrorCodeForbidden, errClientEventsDisabled
+	}
+
+	return channel, 0, nil
 }
 
 func (client *Client) handleLeaveChannelMessage(message Message) {
@@ -213,35 +382,101 @@ func (client *Client) handleLeaveChannelMessage(message Message) {
 		return
 	}
 
-	if client.isInChannel(channel) {
-		delete(client.channels, channel)
+	// Leaving a channel we're not in would announce a member that never joined
+	if !client.isInChannel(channel) {
+		log.Printf("Tried to leave a channel it's not in %s", message.Name)
+		return
 	}
 
+	delete(client.channels, channel)
+	delete(client.members, channel)
+
 	channel.unsubscribe <- client
+	client.dropAcks(channel.Name)
 
 	client.notifyChannelLeave(channel, nil)
 }
 
+// handleHistoryMessage replays history of a channel the client is in, for
+// instance to fill a gap in the sequence numbers it received.
+func (client *Client) handleHistoryMessage(message Message) {
+	channel := client.wsServer.findChannelByName(message.Name)
+
+	if channel == nil || !client.isInChannel(channel) {
+		client.sendError(message.Name, ErrorCodeForbidden, errHistoryNotSubscribed.Error())
+		return
+	}
+
+	if !channel.history {
+		client.sendError(message.Name, ErrorCodeBadRequest, errHistoryDisabled.Error())
+		return
+	}
+
+	request := message.History
+	if request == nil {
+		request = &HistoryRequest{}
+	}
+
+	channel.replay <- &Subscription{client: client, history: request}
+}
+
 func (client *Client) joinChannel(message Message) {
 	channelName := message.Name
 	sender := message.Sender
+	private := isPrivateChannelName(channelName)
 
-	channel := client.wsServer.findChannelByName(channelName)
-
-	if channel == nil {
-		channel = client.wsServer.createChannel(channelName, sender == nil)
+	if message.Action == JoinChannelPrivateAction && !private {
+		client.sendError(channelName, ErrorCodeBadRequest, errInvalidPrivateName.Error())
+		return
 	}
 
-	// Don't allow to join private channels through public channel message
-	if sender != nil && channel.Private {
-		log.Printf("Tried to join private channel through public channel message %s", channel.Name)
+	if !client.isGranted(channelName, GrantSubscribe) {
+		client.sendError(channelName, ErrorCodeForbidden, errSubscribeDenied.Error())
 		return
 	}
 
+	var member *Member
+
+	// Private and presence channels require a signed auth before subscribing
+	if private {
+		if err := verifyChannelAuth(client.wsServer.app, message.Auth, client.GetId(), channelName, message.ChannelData); err != nil {
+			log.Printf("Rejected join for channel %s: %s", channelName, err)
+			client.sendError(channelName, ErrorCodeUnauthorized, err.Error())
+			return
+		}
+
+		// Don't reveal the sender to members of private channels
+		sender = nil
+	}
+
+	if isPresenceChannelName(channelName) {
+		var err error
+
+		if member, err = parseChannelData(message.ChannelData); err != nil {
+			client.sendError(channelName, ErrorCodeBadRequest, err.Error())
+			return
+		}
+
+		// An authenticated connection can only be present as its own user
+		if len(client.UserID) > 0 && member.UserID != client.UserID {
+			client.sendError(channelName, ErrorCodeForbidden, errPresenceUserMismatch.Error())
+			return
+		}
+	}
+
+	channel := client.wsServer.findChannelByName(channelName)
+
+	if channel == nil {
+		channel = client.wsServer.createChannel(channelName, private)
+	}
+
 	if !client.isInChannel(channel) {
 
 		client.channels[channel] = true
-		channel.subscribe <- client
+		if member != nil {
+			client.members[channel] = member
+		}
+		channel.subscribe <- &Subscription{client: client, member: member, history: message.History}
 
 		client.notifyChannelJoined(channel, sender)
 	}
@@ -281,6 +516,10 @@ func (client *Client) notifyChannelLeave(channel *Channel, sender *Client) {
 	client.send <- message.encode()
 }
 
+func (client *Client) sendError(name string, code int, text string) {
+	client.send <- newErrorMessage(name, code, text).encode()
+}
+
 func (client *Client) GetId() string {
 	return client.ID.String()
 }
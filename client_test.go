@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// sendClientEvent has the sender handle the frame, broadcasting what it
+// publishes in the channel.
+func sendClientEvent(channel *Channel, sender *Client, frame string) {
+	done := make(chan bool)
+
+	go func() {
+		sender.handleNewMessage([]byte(frame))
+		close(done)
+	}()
+
+	select {
+
+	case message := <-channel.broadcast:
+		channel.broadcastMessage(message)
+		<-done
+
+	case <-done:
+	}
+}
+
+func TestClientEvents(t *testing.T) {
+	tests := []struct {
+		name      string
+		app       *App
+		channel   string
+		event     string
+		delivered bool
+		err       error
+	}{
+		{"private channel", &App{ClientEvents: true}, "private-chat", "client-typing", true, nil},
+		{"presence channel", &App{ClientEvents: true}, "presence-chat", "client-typing", true, nil},
+		{"allowed channel", &App{ClientEvents: true, ClientEventChannels: []string{"private-chat"}}, "private-chat", "client-typing", true, nil},
+		{"disabled for the app", &App{}, "private-chat", "client-typing", false, errClientEventsDisabled},
+		{"disabled for the channel", &App{ClientEvents: true, ClientEventChannels: []string{"private-other-*"}}, "private-chat", "client-typing", false, errClientEventsDisabled},
+		{"public channel", &App{ClientEvents: true}, "chat", "client-typing", false, errClientEventNotPrivate},
+		{"not a client event", &App{ClientEvents: true}, "private-chat", "typing", false, errNotClientEvent},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.app.Key = "key"
+			server := newWebsocketServer(test.app, newMemoryBroker(), "node", nil)
+
+			channel := NewChannel(server, test.channel, isPrivateChannelName(test.channel), 0)
+			server.channels[channel] = true
+
+			sender := newTestRecipient(server)
+			receiver := newTestRecipient(server)
+
+			for _, client := range []*Client{sender, receiver} {
+				client.channels = map[*Channel]bool{channel: true}
+				channel.subscribeClientInChannel(&Subscription{client: client})
+			}
+
+			drainFrames(sender)
+			drainFrames(receiver)
+
+			sendClientEvent(channel, sender, `{"action":"send_message","name":"`+test.channel+`","event":"`+test.event+`","data":{"text":"hi"}}`)
+
+			received := drainFrames(receiver)
+
+			if test.delivered {
+				if len(received) != 1 || received[0].Event != test.event || string(received[0].Data) != `{"text":"hi"}` {
+					t.Fatalf("got %+v, want the event delivered", received)
+				}
+
+				// Client events are not echoed back to the sender
+				if frames := drainFrames(sender); len(frames) != 0 {
+					t.Errorf("got %d frames sent back to the sender, want none", len(frames))
+				}
+
+				return
+			}
+
+			if len(received) != 0 {
+				t.Errorf("got %d frames delivered, want none", len(received))
+			}
+
+			rejected := framesWithAction(sender, ErrorAction)
+			if len(rejected) != 1 {
+				t.Fatalf("got %d errors, want 1", len(rejected))
+			}
+
+			var data ErrorData
+			json.Unmarshal(rejected[0].Data, &data)
+
+			if data.Message != test.err.Error() {
+				t.Errorf("got error %q, want %q", data.Message, test.err)
+			}
+		})
+	}
+}
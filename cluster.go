@@ -0,0 +1,479 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Wait time before redialing a peer.
+	clusterDialWait = 2 * time.Second
+)
+
+const clusterHello = "hello"
+const clusterAuth = "auth"
+const clusterSubscribe = "subscribe"
+const clusterUnsubscribe = "unsubscribe"
+const clusterPublish = "publish"
+
+var (
+	errClusterNoListen = errors.New("CLUSTER_LISTEN is required for the cluster broker")
+	errClusterNoSecret = errors.New("CLUSTER_SECRET is required for the cluster broker")
+	errClusterAuth     = errors.New("cluster peer failed to authenticate")
+)
+
+// clusterFrame is a newline delimited JSON frame exchanged between nodes.
+// Hellos carry a Nonce the other node proves it knows the cluster secret
+// with, by answering with the MAC of its node id and that nonce.
+type clusterFrame struct {
+	Type    string   `json:"type"`
+	Node    string   `json:"node,omitempty"`
+	Nonce   string   `json:"nonce,omitempty"`
+	MAC     string   `json:"mac,omitempty"`
+	Topics  []string `json:"topics,omitempty"`
+	Topic   string   `json:"topic,omitempty"`
+	Payload []byte   `json:"payload,omitempty"`
+}
+
+// clusterNode is another node of the cluster. We send to it on the
+// connection we dialed, and it tells us its topics on the one it dialed.
+type clusterNode struct {
+	conn    *clusterConn
+	inbound net.Conn
+	topics  map[string]bool
+}
+
+type clusterConn struct {
+	conn    net.Conn
+	encoder *json.Encoder
+	mu      sync.Mutex
+}
+
+func newClusterConn(conn net.Conn) *clusterConn {
+	return &clusterConn{conn: conn, encoder: json.NewEncoder(conn)}
+}
+
+func (clusterConn *clusterConn) send(frame *clusterFrame) error {
+	clusterConn.mu.Lock()
+	defer clusterConn.mu.Unlock()
+
+	clusterConn.conn.SetWriteDeadline(time.Now().Add(writeWait))
+
+	return clusterConn.encoder.Encode(frame)
+}
+
+// ClusterBroker connects gosocks nodes directly over TCP using a static peer
+// list. Nodes exchange the topics they subscribe to, and publishes are only
+// forwarded to the nodes that subscribe to the topic. Peers must prove they
+// share the cluster secret before anything they send is accepted.
+type ClusterBroker struct {
+	nodeId   string
+	secret   []byte
+	listener net.Listener
+	handlers map[string]func(payload []byte)
+	nodes    map[string]*clusterNode
+	closed   bool
+	mu       sync.Mutex
+}
+
+// newClusterBroker listens for peers on listen and dials every peer address,
+// authenticating peers with secret. The peer list may include this node's own
+// address.
+func newClusterBroker(nodeId string, listen string, secret string, peers []string) (*ClusterBroker, error) {
+	if len(listen) == 0 {
+		return nil, errClusterNoListen
+	}
+
+	if len(secret) == 0 {
+		return nil, errClusterNoSecret
+	}
+
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	broker := &ClusterBroker{
+		nodeId:   nodeId,
+		secret:   []byte(secret),
+		listener: listener,
+		handlers: make(map[string]func(payload []byte)),
+		nodes:    make(map[string]*clusterNode),
+	}
+
+	go broker.accept()
+
+	for _, address := range peers {
+		go broker.dial(address)
+	}
+
+	return broker, nil
+}
+
+func (broker *ClusterBroker) Publish(topic string, payload []byte) (int, error) {
+	broker.mu.Lock()
+	handler, local := broker.handlers[topic]
+
+	conns := make([]*clusterConn, 0, len(broker.nodes))
+	for _, node := range broker.nodes {
+		if node.conn != nil && node.topics[topic] {
+			conns = append(conns, node.conn)
+		}
+	}
+	broker.mu.Unlock()
+
+	receivers := 0
+
+	if local {
+		handler(payload)
+		receivers++
+	}
+
+	frame := &clusterFrame{Type: clusterPublish, Topic: topic, Payload: payload}
+
+	for _, conn := range conns {
+		if err := conn.send(frame); err != nil {
+			log.Printf("Error on publishing to cluster peer %s", err)
+			continue
+		}
+
+		receivers++
+	}
+
+	return receivers, nil
+}
+
+func (broker *ClusterBroker) Subscribe(topic string, handler func(payload []byte)) error {
+	broker.mu.Lock()
+	broker.handlers[topic] = handler
+	conns := broker.outboundConns()
+	broker.mu.Unlock()
+
+	broker.sendAll(conns, &clusterFrame{Type: clusterSubscribe, Topics: []string{topic}})
+
+	return nil
+}
+
+func (broker *ClusterBroker) Unsubscribe(topic string) error {
+	broker.mu.Lock()
+	delete(broker.handlers, topic)
+	conns := broker.outboundConns()
+	broker.mu.Unlock()
+
+	broker.sendAll(conns, &clusterFrame{Type: clusterUnsubscribe, Topics: []string{topic}})
+
+	return nil
+}
+
+func (broker *ClusterBroker) Close() error {
+	broker.mu.Lock()
+	broker.closed = true
+
+	for _, node := range broker.nodes {
+		if node.conn != nil {
+			node.conn.conn.Close()
+		}
+	}
+	broker.mu.Unlock()
+
+	return broker.listener.Close()
+}
+
+// dial keeps an outbound connection open to the peer at address.
+func (broker *ClusterBroker) dial(address string) {
+	for !broker.isClosed() {
+		conn, err := net.DialTimeout("tcp", address, writeWait)
+
+		if err != nil {
+			time.Sleep(clusterDialWait)
+			continue
+		}
+
+		clusterConn := newClusterConn(conn)
+		decoder := json.NewDecoder(conn)
+
+		hello, err := broker.dialHandshake(clusterConn, decoder)
+
+		if err != nil {
+			log.Printf("Error on connecting cluster peer %s %s", address, err)
+			conn.Close()
+			time.Sleep(clusterDialWait)
+			continue
+		}
+
+		// The peer list can include ourselves
+		if hello.Node == broker.nodeId {
+			conn.Close()
+			return
+		}
+
+		broker.attachOutbound(hello.Node, clusterConn)
+
+		// Peers never write on this connection again, so this returns when it drops
+		var frame clusterFrame
+		decoder.Decode(&frame)
+
+		broker.detachOutbound(hello.Node, clusterConn)
+		conn.Close()
+
+		time.Sleep(clusterDialWait)
+	}
+}
+
+func (broker *ClusterBroker) accept() {
+	for {
+		conn, err := broker.listener.Accept()
+
+		if err != nil {
+			if broker.isClosed() {
+				return
+			}
+
+			log.Printf("Error on accepting cluster peer %s", err)
+			continue
+		}
+
+		go broker.serveInbound(conn)
+	}
+}
+
+// dialHandshake authenticates an outbound connection. Our hello carries a
+// nonce, which the peer's hello answers with its MAC; our auth frame then
+// answers the nonce of the peer's hello.
+func (broker *ClusterBroker) dialHandshake(conn *clusterConn, decoder *json.Decoder) (*clusterFrame, error) {
+	conn.conn.SetReadDeadline(time.Now().Add(writeWait))
+	defer conn.conn.SetReadDeadline(time.Time{})
+
+	nonce := newClusterNonce()
+
+	if err := conn.send(&clusterFrame{Type: clusterHello, Node: broker.nodeId, Nonce: nonce}); err != nil {
+		return nil, err
+	}
+
+	var hello clusterFrame
+
+	if err := decoder.Decode(&hello); err != nil {
+		return nil, err
+	}
+
+	if hello.Type != clusterHello || len(hello.Node) == 0 || len(hello.Nonce) == 0 ||
+		!hmac.Equal([]byte(hello.MAC), []byte(broker.clusterMAC(clusterHello, hello.Node, nonce))) {
+		return nil, errClusterAuth
+	}
+
+	if err := conn.send(&clusterFrame{Type: clusterAuth, MAC: broker.clusterMAC(clusterAuth, broker.nodeId, hello.Nonce)}); err != nil {
+		return nil, err
+	}
+
+	return &hello, nil
+}
+
+// acceptHandshake authenticates an inbound connection, the other side of
+// dialHandshake.
+func (broker *ClusterBroker) acceptHandshake(conn *clusterConn, decoder *json.Decoder) (*clusterFrame, error) {
+	conn.conn.SetReadDeadline(time.Now().Add(writeWait))
+	defer conn.conn.SetReadDeadline(time.Time{})
+
+	var hello clusterFrame
+
+	if err := decoder.Decode(&hello); err != nil {
+		return nil, err
+	}
+
+	if hello.Type != clusterHello || len(hello.Node) == 0 || len(hello.Nonce) == 0 {
+		return nil, errClusterAuth
+	}
+
+	nonce := newClusterNonce()
+
+	reply := &clusterFrame{
+		Type:  clusterHello,
+		Node:  broker.nodeId,
+		Nonce: nonce,
+		MAC:   broker.clusterMAC(clusterHello, broker.nodeId, hello.Nonce),
+	}
+
+	if err := conn.send(reply); err != nil {
+		return nil, err
+	}
+
+	var auth clusterFrame
+
+	if err := decoder.Decode(&auth); err != nil {
+		return nil, err
+	}
+
+	if auth.Type != clusterAuth || !hmac.Equal([]byte(auth.MAC), []byte(broker.clusterMAC(clusterAuth, hello.Node, nonce))) {
+		return nil, errClusterAuth
+	}
+
+	return &hello, nil
+}
+
+// clusterMAC is the hex encoded HMAC-SHA256 of step:node:nonce with the
+// cluster secret. The step keeps a peer's answer in one step from being
+// replayed in the other.
+func (broker *ClusterBroker) clusterMAC(step string, node string, nonce string) string {
+	mac := hmac.New(sha256.New, broker.secret)
+	mac.Write([]byte(step + ":" + node + ":" + nonce))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newClusterNonce() string {
+	nonce := make([]byte, 16)
+
+	if _, err := rand.Read(nonce); err != nil {
+		log.Fatal("Error on generating cluster nonce: ", err)
+	}
+
+	return hex.EncodeToString(nonce)
+}
+
+// serveInbound reads the topics and publishes sent by a peer.
+func (broker *ClusterBroker) serveInbound(conn net.Conn) {
+	defer conn.Close()
+
+	decoder := json.NewDecoder(conn)
+
+	hello, err := broker.acceptHandshake(newClusterConn(conn), decoder)
+
+	if err != nil {
+		log.Printf("Rejected cluster peer %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+
+	if hello.Node == broker.nodeId {
+		return
+	}
+
+	broker.attachInbound(hello.Node, conn)
+	defer broker.detachInbound(hello.Node, conn)
+
+	for {
+		var frame clusterFrame
+
+		if err := decoder.Decode(&frame); err != nil {
+			return
+		}
+
+		switch frame.Type {
+
+		case clusterSubscribe, clusterUnsubscribe:
+			broker.mu.Lock()
+			// A connection the node has since replaced no longer speaks for it
+			if node := broker.findNode(hello.Node); node.inbound == conn {
+				for _, topic := range frame.Topics {
+					if frame.Type == clusterSubscribe {
+						node.topics[topic] = true
+					} else {
+						delete(node.topics, topic)
+					}
+				}
+			}
+			broker.mu.Unlock()
+
+		case clusterPublish:
+			broker.mu.Lock()
+			handler, ok := broker.handlers[frame.Topic]
+			broker.mu.Unlock()
+
+			if ok {
+				handler(frame.Payload)
+			}
+		}
+	}
+}
+
+func (broker *ClusterBroker) attachOutbound(nodeId string, conn *clusterConn) {
+	broker.mu.Lock()
+	node := broker.findNode(nodeId)
+	node.conn = conn
+
+	topics := make([]string, 0, len(broker.handlers))
+	for topic := range broker.handlers {
+		topics = append(topics, topic)
+	}
+	broker.mu.Unlock()
+
+	if len(topics) > 0 {
+		conn.send(&clusterFrame{Type: clusterSubscribe, Topics: topics})
+	}
+}
+
+func (broker *ClusterBroker) detachOutbound(nodeId string, conn *clusterConn) {
+	broker.mu.Lock()
+	if node := broker.findNode(nodeId); node.conn == conn {
+		node.conn = nil
+	}
+	broker.mu.Unlock()
+}
+
+// attachInbound makes conn the node's connection to us, replacing any it had
+// before along with the topics sent on it.
+func (broker *ClusterBroker) attachInbound(nodeId string, conn net.Conn) {
+	broker.mu.Lock()
+	node := broker.findNode(nodeId)
+	node.inbound = conn
+	node.topics = make(map[string]bool)
+	broker.mu.Unlock()
+}
+
+// detachInbound forgets a node's topics once its connection to us drops,
+// unless the node has already reconnected.
+func (broker *ClusterBroker) detachInbound(nodeId string, conn net.Conn) {
+	broker.mu.Lock()
+	if node := broker.findNode(nodeId); node.inbound == conn {
+		node.inbound = nil
+		node.topics = make(map[string]bool)
+	}
+	broker.mu.Unlock()
+}
+
+// findNode returns the node with the id, creating it. Callers hold mu.
+func (broker *ClusterBroker) findNode(nodeId string) *clusterNode {
+	node, ok := broker.nodes[nodeId]
+
+	if !ok {
+		node = &clusterNode{topics: make(map[string]bool)}
+		broker.nodes[nodeId] = node
+	}
+
+	return node
+}
+
+// outboundConns returns the connections to every node. Callers hold mu.
+func (broker *ClusterBroker) outboundConns() []*clusterConn {
+	conns := make([]*clusterConn, 0, len(broker.nodes))
+
+	for _, node := range broker.nodes {
+		if node.conn != nil {
+			conns = append(conns, node.conn)
+		}
+	}
+
+	return conns
+}
+
+func (broker *ClusterBroker) sendAll(conns []*clusterConn, frame *clusterFrame) {
+	for _, conn := range conns {
+		if err := conn.send(frame); err != nil {
+			log.Printf("Error on sending to cluster peer %s", err)
+		}
+	}
+}
+
+func (broker *ClusterBroker) isClosed() bool {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	return broker.closed
+}
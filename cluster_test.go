@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestClusterBroker(t *testing.T, nodeId string, secret string) *ClusterBroker {
+	broker, err := newClusterBroker(nodeId, "127.0.0.1:0", secret, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { broker.Close() })
+
+	return broker
+}
+
+// connectClusterBrokers has the brokers dial each other.
+func connectClusterBrokers(a *ClusterBroker, b *ClusterBroker) {
+	go a.dial(b.listener.Addr().String())
+	go b.dial(a.listener.Addr().String())
+}
+
+func TestClusterBrokerPublish(t *testing.T) {
+	a := newTestClusterBroker(t, "a", "secret")
+	b := newTestClusterBroker(t, "b", "secret")
+
+	received := make(chan []byte, 1)
+	a.Subscribe("topic", func(payload []byte) { received <- payload })
+
+	connectClusterBrokers(a, b)
+
+	waitFor(t, "the delivery", func() bool {
+		if receivers, _ := b.Publish("topic", []byte("payload")); receivers == 0 {
+			return false
+		}
+
+		return string(<-received) == "payload"
+	})
+}
+
+func TestClusterBrokerRejectsWrongSecret(t *testing.T) {
+	a := newTestClusterBroker(t, "a", "secret")
+	b := newTestClusterBroker(t, "b", "other")
+
+	a.Subscribe("topic", func(payload []byte) {
+		t.Errorf("received a payload from a node with the wrong secret")
+	})
+
+	connectClusterBrokers(a, b)
+
+	time.Sleep(200 * time.Millisecond)
+
+	if receivers, _ := b.Publish("topic", []byte("payload")); receivers != 0 {
+		t.Errorf("got %d receivers, want 0", receivers)
+	}
+}
+
+func TestClusterBrokerRejectsUnauthenticatedFrames(t *testing.T) {
+	broker := newTestClusterBroker(t, "a", "secret")
+
+	received := make(chan []byte, 1)
+	broker.Subscribe("topic", func(payload []byte) { received <- payload })
+
+	conn, err := net.Dial("tcp", broker.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+
+	encoder.Encode(&clusterFrame{Type: clusterHello, Node: "intruder", Nonce: "nonce"})
+
+	var hello clusterFrame
+	if err := decoder.Decode(&hello); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the secret the intruder can only guess the MAC
+	encoder.Encode(&clusterFrame{Type: clusterAuth, MAC: hello.MAC})
+	encoder.Encode(&clusterFrame{Type: clusterPublish, Topic: "topic", Payload: []byte("forged")})
+
+	select {
+
+	case payload := <-received:
+		t.Errorf("accepted a frame from an unauthenticated peer: %s", payload)
+
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// dialTestPeer authenticates a connection to the broker as the node, as the
+// node's dial would.
+func dialTestPeer(t *testing.T, broker *ClusterBroker, nodeId string) (net.Conn, *json.Encoder) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", broker.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+
+	encoder.Encode(&clusterFrame{Type: clusterHello, Node: nodeId, Nonce: "nonce"})
+
+	var hello clusterFrame
+	if err := decoder.Decode(&hello); err != nil {
+		t.Fatal(err)
+	}
+
+	// The peer shares the secret, so it signs as the broker would
+	encoder.Encode(&clusterFrame{Type: clusterAuth, MAC: broker.clusterMAC(clusterAuth, nodeId, hello.Nonce)})
+
+	return conn, encoder
+}
+
+// nodeTopic reports whether the node told the broker it subscribes to topic.
+func nodeTopic(broker *ClusterBroker, nodeId string, topic string) bool {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	node, ok := broker.nodes[nodeId]
+
+	return ok && node.topics[topic]
+}
+
+func TestClusterBrokerReconnectWhileOldConnLingers(t *testing.T) {
+	broker := newTestClusterBroker(t, "a", "secret")
+
+	old, oldEncoder := dialTestPeer(t, broker, "b")
+	oldEncoder.Encode(&clusterFrame{Type: clusterSubscribe, Topics: []string{"old"}})
+
+	waitFor(t, "the first subscription", func() bool { return nodeTopic(broker, "b", "old") })
+
+	_, encoder := dialTestPeer(t, broker, "b")
+	encoder.Encode(&clusterFrame{Type: clusterSubscribe, Topics: []string{"topic"}})
+
+	waitFor(t, "the subscription on the new connection", func() bool { return nodeTopic(broker, "b", "topic") })
+
+	if nodeTopic(broker, "b", "old") {
+		t.Error("got the topics of the old connection kept")
+	}
+
+	// The old connection can neither change the topics nor clear them
+	oldEncoder.Encode(&clusterFrame{Type: clusterUnsubscribe, Topics: []string{"topic"}})
+	oldEncoder.Encode(&clusterFrame{Type: clusterSubscribe, Topics: []string{"stale"}})
+	old.Close()
+
+	time.Sleep(200 * time.Millisecond)
+
+	if !nodeTopic(broker, "b", "topic") || nodeTopic(broker, "b", "stale") {
+		t.Error("got the topics of the new connection changed by the old one")
+	}
+}
+
+func TestClusterBrokerRequiresConfig(t *testing.T) {
+	if _, err := newClusterBroker("a", "", "secret", nil); err != errClusterNoListen {
+		t.Errorf("got %v, want %v", err, errClusterNoListen)
+	}
+
+	if _, err := newClusterBroker("a", "127.0.0.1:0", "", nil); err != errClusterNoSecret {
+		t.Errorf("got %v, want %v", err, errClusterNoSecret)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+// Codec is the wire encoding of a connection. Messages are queued for a
+// client in their JSON encoding, as broadcasts, history and acks share them,
+// and the connection's codec converts them when they are written. Frames read
+// are converted back to JSON before they are handled.
+type Codec interface {
+	// Name is the encoding reported in the connection features.
+	Name() string
+
+	// FrameType is the websocket message type of the frames written.
+	FrameType() int
+
+	Encode(message []byte) ([]byte, error)
+
+	Decode(frame []byte) ([]byte, error)
+}
+
+// codecFor returns the codec of a negotiated subprotocol, JSON unless the
+// client asked for a binary encoding.
+func codecFor(subprotocol string) Codec {
+	switch subprotocol {
+
+	case MsgpackSubprotocol:
+		return MsgpackCodec{}
+
+	case ProtobufSubprotocol:
+		return ProtobufCodec{}
+	}
+
+	return JSONCodec{}
+}
+
+// JSONCodec writes messages as JSON text frames, as they are queued.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) FrameType() int {
+	return websocket.TextMessage
+}
+
+func (JSONCodec) Encode(message []byte) ([]byte, error) {
+	return message, nil
+}
+
+func (JSONCodec) Decode(frame []byte) ([]byte, error) {
+	return frame, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const SendToUserAction = "send_to_user"
+const SendToSocketAction = "send_to_socket"
+const DirectMessageAction = "direct_message"
+
+// Claim allowing a connection to send direct messages to other users and
+// sockets.
+const directMessagesClaim = "direct_messages"
+
+var (
+	errDirectDenied   = errors.New("token does not grant direct messages")
+	errDirectNoUser   = errors.New("send_to_user requires a user_id")
+	errDirectNoSocket = errors.New("send_to_socket requires a socket_id")
+)
+
+// DirectEventRequest is the body accepted by the send_to_user and
+// send_to_socket endpoints.
+type DirectEventRequest struct {
+	Name     string          `json:"name"`
+	UserID   string          `json:"user_id"`
+	SocketID string          `json:"socket_id"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// handleDirectMessage sends a client event to every connection of a user, or
+// to a single socket, if the client's token allows it.
+func (client *Client) handleDirectMessage(message *Message) {
+	if !isClientEvent(message.Event) {
+		client.sendError(message.Name, ErrorCodeBadRequest, errNotClientEvent.Error())
+		return
+	}
+
+	var allowed bool
+	if client.claims == nil || !client.claims.Get(directMessagesClaim, &allowed) || !allowed {
+		client.sendError(message.Name, ErrorCodeForbidden, errDirectDenied.Error())
+		return
+	}
+
+	direct := &Message{
+		Action:    DirectMessageAction,
+		Event:     message.Event,
+		Data:      message.Data,
+		Sender:    client,
+		Timestamp: time.Now().Unix(),
+		UserID:    client.UserID,
+		ID:        uuid.New().String(),
+	}
+
+	if message.Action == SendToUserAction {
+		if len(message.UserID) == 0 {
+			client.sendError(message.Name, ErrorCodeBadRequest, errDirectNoUser.Error())
+			return
+		}
+
+		client.wsServer.sendToUser(message.UserID, direct)
+		return
+	}
+
+	if len(message.SocketID) == 0 {
+		client.sendError(message.Name, ErrorCodeBadRequest, errDirectNoSocket.Error())
+		return
+	}
+
+	client.wsServer.sendToSocket(message.SocketID, direct)
+}
+
+// sendToUser sends a message to every connection whose token was issued to
+// the user, on this node and every other.
+func (server *WsServer) sendToUser(userId string, message *Message) {
+	envelope := &BrokerEnvelope{Kind: BrokerUser, Message: message, User: userId}
+
+	if _, err := server.publishEnvelope(server.serverTopic(), envelope); err != nil {
+		log.Printf("Error on publishing to broker %s", err)
+	}
+
+	server.direct <- envelope
+}
+
+// deliverDirect hands a direct envelope to the local clients it is for. Only
+// used from the Run goroutine, which owns clients.
+func (server *WsServer) deliverDirect(envelope *BrokerEnvelope) {
+	if envelope.Kind == BrokerUser {
+		encoded := envelope.Message.encode()
+
+		for client := range server.clients {
+			if len(client.UserID) > 0 && client.UserID == envelope.User {
+				client.send <- encoded
+			}
+		}
+
+		return
+	}
+
+	client := server.findClientByID(envelope.Socket)
+
+	if client == nil {
+		return
+	}
+
+	// Replies only reach a client still waiting for them
+	if envelope.Message.Action == ReplyAction {
+		client.receiveReply(envelope.Message)
+	} else {
+		client.send <- envelope.Message.encode()
+	}
+}
+
+// serveSendToUser handles events sent by backend services to every connection
+// of a user.
+func serveSendToUser(wsServer *WsServer, w http.ResponseWriter, r *http.Request) {
+	request, ok := decodeDirectEvent(wsServer, w, r)
+	if !ok {
+		return
+	}
+
+	if len(request.UserID) == 0 {
+		http.Error(w, "user_id is required", http.StatusBadRequest)
+		return
+	}
+
+	wsServer.sendToUser(request.UserID, request.message())
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// serveSendToSocket handles events sent by backend services to a single
+// socket.
+func serveSendToSocket(wsServer *WsServer, w http.ResponseWriter, r *http.Request) {
+	request, ok := decodeDirectEvent(wsServer, w, r)
+	if !ok {
+		return
+	}
+
+	if len(request.SocketID) == 0 {
+		http.Error(w, "socket_id is required", http.StatusBadRequest)
+		return
+	}
+
+	wsServer.sendToSocket(request.SocketID, request.message())
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func decodeDirectEvent(wsServer *WsServer, w http.ResponseWriter, r *http.Request) (*DirectEventRequest, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	var request DirectEventRequest
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxEventBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return nil, false
+	}
+
+	if len(request.Name) == 0 {
+		http.Error(w, "Event name is required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	if len(request.Data) > wsServer.app.maxDataSize() {
+		http.Error(w, "Data too large", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+
+	return &request, true
+}
+
+func (request *DirectEventRequest) message() *Message {
+	return &Message{
+		Action:    DirectMessageAction,
+		Event:     request.Name,
+		Data:      request.Data,
+		Timestamp: time.Now().Unix(),
+		ID:        uuid.New().String(),
+	}
+}
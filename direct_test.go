@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newDirectTestServer returns a server delivering direct messages to the
+// clients, which are registered as if they had connected.
+func newDirectTestServer(app *App, clients ...*Client) *WsServer {
+	server := newWebsocketServer(app, newMemoryBroker(), "node", nil)
+
+	for _, client := range clients {
+		client.wsServer = server
+		server.clients[client] = true
+	}
+
+	go func() {
+		for envelope := range server.direct {
+			server.deliverDirect(envelope)
+		}
+	}()
+
+	return server
+}
+
+// flushDirect returns once the direct messages sent so far were delivered.
+func flushDirect(server *WsServer) {
+	server.direct <- &BrokerEnvelope{Kind: BrokerSocket}
+}
+
+func newDirectTestClient(userId string, claims *Claims) *Client {
+	client := newTestRecipient(nil)
+	client.UserID = userId
+	client.claims = claims
+
+	return client
+}
+
+func TestDirectMessages(t *testing.T) {
+	allowed := &Claims{raw: map[string]json.RawMessage{directMessagesClaim: json.RawMessage("true")}}
+
+	sender := newDirectTestClient("carol", allowed)
+	alice1 := newDirectTestClient("alice", nil)
+	alice2 := newDirectTestClient("alice", nil)
+	bob := newDirectTestClient("bob", nil)
+
+	server := newDirectTestServer(&App{Key: "key"}, sender, alice1, alice2, bob)
+
+	tests := []struct {
+		name       string
+		frame      string
+		recipients []*Client
+		err        error
+	}{
+		{"to every socket of a user", `{"action":"send_to_user","user_id":"alice","event":"client-dm","data":"hi"}`, []*Client{alice1, alice2}, nil},
+		{"to a socket", `{"action":"send_to_socket","socket_id":"` + alice2.GetId() + `","event":"client-dm","data":"hi"}`, []*Client{alice2}, nil},
+		{"to an unknown user", `{"action":"send_to_user","user_id":"dave","event":"client-dm","data":"hi"}`, nil, nil},
+		{"not a client event", `{"action":"send_to_user","user_id":"alice","event":"dm","data":"hi"}`, nil, errNotClientEvent},
+		{"no user", `{"action":"send_to_user","event":"client-dm","data":"hi"}`, nil, errDirectNoUser},
+		{"no socket", `{"action":"send_to_socket","event":"client-dm","data":"hi"}`, nil, errDirectNoSocket},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sender.handleNewMessage([]byte(test.frame))
+			flushDirect(server)
+
+			for _, client := range []*Client{alice1, alice2, bob} {
+				received := framesWithAction(client, DirectMessageAction)
+
+				want := 0
+				for _, recipient := range test.recipients {
+					if recipient == client {
+						want = 1
+					}
+				}
+
+				if len(received) != want {
+					t.Fatalf("got %d direct messages for %s, want %d", len(received), client.GetId(), want)
+				}
+
+				if want == 1 && (received[0].Event != "client-dm" || received[0].UserID != "carol" || string(received[0].Data) != `"hi"`) {
+					t.Errorf("got %+v, want client-dm from carol", received[0])
+				}
+			}
+
+			rejected := framesWithAction(sender, ErrorAction)
+
+			if test.err == nil {
+				if len(rejected) != 0 {
+					t.Errorf("got %d errors, want none", len(rejected))
+				}
+
+				return
+			}
+
+			if len(rejected) != 1 {
+				t.Fatalf("got %d errors, want 1", len(rejected))
+			}
+
+			var data ErrorData
+			json.Unmarshal(rejected[0].Data, &data)
+
+			if data.Message != test.err.Error() {
+				t.Errorf("got error %q, want %q", data.Message, test.err)
+			}
+		})
+	}
+}
+
+func TestDirectMessagesRequireClaim(t *testing.T) {
+	denied := &Claims{raw: map[string]json.RawMessage{directMessagesClaim: json.RawMessage("false")}}
+
+	for _, sender := range []*Client{newDirectTestClient("carol", nil), newDirectTestClient("carol", denied)} {
+		alice := newDirectTestClient("alice", nil)
+		server := newDirectTestServer(&App{Key: "key"}, sender, alice)
+
+		sender.handleNewMessage([]byte(`{"action":"send_to_user","user_id":"alice","event":"client-dm"}`))
+		flushDirect(server)
+
+		if received := framesWithAction(alice, DirectMessageAction); len(received) != 0 {
+			t.Errorf("got %d direct messages, want none", len(received))
+		}
+
+		rejected := framesWithAction(sender, ErrorAction)
+
+		var data ErrorData
+		if len(rejected) == 1 {
+			json.Unmarshal(rejected[0].Data, &data)
+		}
+
+		if data.Code != ErrorCodeForbidden || data.Message != errDirectDenied.Error() {
+			t.Errorf("got %+v, want direct messages denied", data)
+		}
+	}
+}
+
+func TestDirectMessagesAPI(t *testing.T) {
+	alice1 := newDirectTestClient("alice", nil)
+	alice2 := newDirectTestClient("alice", nil)
+	bob := newDirectTestClient("bob", nil)
+
+	app := &App{Key: "key", ServerKey: "server-key"}
+	app.server = newDirectTestServer(app, alice1, alice2, bob)
+
+	apps := map[string]*App{app.Key: app}
+
+	tests := []struct {
+		name       string
+		endpoint   string
+		serverKey  string
+		body       string
+		status     int
+		recipients []*Client
+	}{
+		{"user", "send_to_user", "server-key", `{"name":"notice","user_id":"alice","data":"hi"}`, http.StatusAccepted, []*Client{alice1, alice2}},
+		{"socket", "send_to_socket", "server-key", `{"name":"notice","socket_id":"` + bob.GetId() + `","data":"hi"}`, http.StatusAccepted, []*Client{bob}},
+		{"no server key", "send_to_user", "", `{"name":"notice","user_id":"alice","data":"hi"}`, http.StatusUnauthorized, nil},
+		{"wrong server key", "send_to_socket", "other", `{"name":"notice","socket_id":"` + bob.GetId() + `","data":"hi"}`, http.StatusUnauthorized, nil},
+		{"no user", "send_to_user", "server-key", `{"name":"notice","data":"hi"}`, http.StatusBadRequest, nil},
+		{"no socket", "send_to_socket", "server-key", `{"name":"notice","data":"hi"}`, http.StatusBadRequest, nil},
+		{"no name", "send_to_user", "server-key", `{"user_id":"alice","data":"hi"}`, http.StatusBadRequest, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/apps/key/"+test.endpoint, strings.NewReader(test.body))
+			if len(test.serverKey) > 0 {
+				request.Header.Set("Authorization", "Bearer "+test.serverKey)
+			}
+
+			recorder := httptest.NewRecorder()
+			serveApps(&JWTVerifier{}, apps, recorder, request)
+			flushDirect(app.server)
+
+			if recorder.Code != test.status {
+				t.Fatalf("got status %d, want %d", recorder.Code, test.status)
+			}
+
+			for _, client := range []*Client{alice1, alice2, bob} {
+				received := framesWithAction(client, DirectMessageAction)
+
+				want := 0
+				for _, recipient := range test.recipients {
+					if recipient == client {
+						want = 1
+					}
+				}
+
+				if len(received) != want {
+					t.Fatalf("got %d direct messages for %s, want %d", len(received), client.GetId(), want)
+				}
+
+				if want == 1 && (received[0].Event != "notice" || received[0].Sender != nil) {
+					t.Errorf("got %+v, want notice from the backend", received[0])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+const (
+	// Maximum number of channels a single event can be triggered on.
+	maxEventChannels = 100
+
+	// Maximum size of an event request body.
+	maxEventBodySize = maxMessageSize
+
+	// Default maximum number of events in a batch request.
+	defaultMaxBatchSize = 10
+)
+
+const BatchStatusDelivered = "delivered"
+const BatchStatusChannelNotFound = "channel_not_found"
+const BatchStatusRejected = "rejected"
+
+// EventRequest is the body accepted by the event trigger endpoint.
+type EventRequest struct {
+	Name     string          `json:"name"`
+	Channel  string          `json:"channel"`
+	Channels []string        `json:"channels"`
+	Data     json.RawMessage `json:"data"`
+	SocketID string          `json:"socket_id"`
+	// ReceiptTo asks for delivery receipts on ack channels, sent to this
+	// socket id or, as "webhook", to the app's webhook.
+	ReceiptTo string `json:"receipt_to"`
+}
+
+// ChannelResult reports the outcome of triggering an event on one channel.
+type ChannelResult struct {
+	Delivered bool   `json:"delivered"`
+	Error     string `json:"error,omitempty"`
+}
+
+// EventResponse is returned by the event trigger endpoint.
+type EventResponse struct {
+	Channels map[string]*ChannelResult `json:"channels"`
+}
+
+// serveEvents handles event trigger requests from backend services.
+func serveEvents(wsServer *WsServer, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request EventRequest
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxEventBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	channels := request.Channels
+	if len(request.Channel) > 0 {
+		channels = append(channels, request.Channel)
+	}
+
+	if len(request.Name) == 0 {
+		http.Error(w, "Event name is required", http.StatusBadRequest)
+		return
+	}
+
+	if len(channels) == 0 {
+		http.Error(w, "At least one channel is required", http.StatusBadRequest)
+		return
+	}
+
+	if len(channels) > maxEventChannels {
+		http.Error(w, "Too many channels", http.StatusBadRequest)
+		return
+	}
+
+	if len(request.Data) > wsServer.app.maxDataSize() {
+		http.Error(w, "Data too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	response := EventResponse{Channels: make(map[string]*ChannelResult)}
+
+	for _, channelName := range channels {
+		result := &ChannelResult{Delivered: true}
+
+		if err := wsServer.triggerEvent(channelName, request.Name, request.Data, request.SocketID, request.ReceiptTo); err != nil {
+			result.Delivered = false
+			result.Error = err.Error()
+		}
+
+		response.Channels[channelName] = result
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error on writing JSON response %s", err)
+	}
+}
+
+// BatchEvent is a single Message-shaped event within a batch request.
+type BatchEvent struct {
+	Name     string          `json:"name"`
+	Event    string          `json:"event"`
+	Data     json.RawMessage `json:"data"`
+	SocketID string          `json:"socket_id"`
+	// ReceiptTo asks for delivery receipts on ack channels, sent to this
+	// socket id or, as "webhook", to the app's webhook.
+	ReceiptTo string `json:"receipt_to"`
+}
+
+// BatchRequest is the body accepted by the batch event trigger endpoint.
+type BatchRequest struct {
+	Batch []BatchEvent `json:"batch"`
+}
+
+// BatchResult reports the outcome of one event in a batch, in request order.
+type BatchResult struct {
+	Index  int    `json:"index"`
+	Name   string `json:"name"`
+	Event  string `json:"event"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BatchResponse is returned by the batch event trigger endpoint.
+type BatchResponse struct {
+	Delivered int            `json:"delivered"`
+	Failed    int            `json:"failed"`
+	Results   []*BatchResult `json:"results"`
+}
+
+// serveBatchEvents handles batch event trigger requests from backend services.
+// Each event is attempted independently so callers can retry only the events
+// that were not delivered.
+func serveBatchEvents(wsServer *WsServer, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request BatchRequest
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(wsServer.app.maxBatchSize())*maxEventBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	if len(request.Batch) == 0 {
+		http.Error(w, "At least one event is required", http.StatusBadRequest)
+		return
+	}
+
+	if len(request.Batch) > wsServer.app.maxBatchSize() {
+		http.Error(w, "Too many events in batch", http.StatusBadRequest)
+		return
+	}
+
+	response := BatchResponse{Results: make([]*BatchResult, 0, len(request.Batch))}
+
+	for i, event := range request.Batch {
+		result := &BatchResult{Index: i, Name: event.Name, Event: event.Event}
+
+		switch {
+		case len(event.Name) == 0:
+			result.Status = BatchStatusRejected
+			result.Error = "channel name is required"
+
+		case len(event.Event) == 0:
+			result.Status = BatchStatusRejected
+			result.Error = "event name is required"
+
+		case len(event.Data) > wsServer.app.maxDataSize():
+			result.Status = BatchStatusRejected
+			result.Error = errDataTooLarge.Error()
+
+		default:
+			if err := wsServer.triggerEvent(event.Name, event.Event, event.Data, event.SocketID, event.ReceiptTo); err != nil {
+				result.Status = BatchStatusChannelNotFound
+				result.Error = err.Error()
+			} else {
+				result.Status = BatchStatusDelivered
+			}
+		}
+
+		if result.Status == BatchStatusDelivered {
+			response.Delivered++
+		} else {
+			response.Failed++
+		}
+
+		response.Results = append(response.Results, result)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
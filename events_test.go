@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postEvent(server *WsServer, handler func(*WsServer, http.ResponseWriter, *http.Request), body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler(server, recorder, httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(body)))
+
+	return recorder
+}
+
+func TestServeEventsData(t *testing.T) {
+	server := newWebsocketServer(&App{Key: "key", MaxDataSize: 64}, newMemoryBroker(), "node", nil)
+
+	tests := []struct {
+		name   string
+		data   string
+		status int
+	}{
+		{"object", `{"text":"hi","n":[1,2]}`, http.StatusOK},
+		{"string", `"hi"`, http.StatusOK},
+		{"invalid JSON", `{"text":`, http.StatusBadRequest},
+		{"over the app limit", `"` + strings.Repeat("a", 64) + `"`, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, test := range tests {
+		body := `{"name":"event","channel":"chat","data":` + test.data + `}`
+
+		if recorder := postEvent(server, serveEvents, body); recorder.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, recorder.Code, test.status)
+		}
+	}
+}
+
+func TestServeBatchEventsData(t *testing.T) {
+	server := newWebsocketServer(&App{Key: "key", MaxDataSize: 64}, newMemoryBroker(), "node", nil)
+
+	body := `{"batch":[
+		{"name":"chat","event":"event","data":{"text":"hi"}},
+		{"name":"chat","event":"event","data":"` + strings.Repeat("a", 64) + `"}
+	]}`
+
+	recorder := postEvent(server, serveBatchEvents, body)
+
+	var response BatchResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody is in the channel, but only the large event is rejected
+	if response.Results[0].Status != BatchStatusChannelNotFound {
+		t.Errorf("got %s for the structured event", response.Results[0].Status)
+	}
+
+	if response.Results[1].Status != BatchStatusRejected || response.Results[1].Error != errDataTooLarge.Error() {
+		t.Errorf("got %s %s for the large event", response.Results[1].Status, response.Results[1].Error)
+	}
+}
+
+func TestServeBatchEventsResults(t *testing.T) {
+	server := newWebsocketServer(&App{Key: "key", MaxBatchSize: 4}, newMemoryBroker(), "node", nil)
+	server.createChannel("chat", false)
+
+	body := `{"batch":[
+		{"name":"chat","event":"event","data":"delivered"},
+		{"name":"gone","event":"event","data":"no channel"},
+		{"name":"","event":"event"},
+		{"name":"chat","event":""}
+	]}`
+
+	recorder := postEvent(server, serveBatchEvents, body)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200 with per-event results", recorder.Code)
+	}
+
+	var response BatchResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{BatchStatusDelivered, BatchStatusChannelNotFound, BatchStatusRejected, BatchStatusRejected}
+
+	if len(response.Results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(response.Results), len(want))
+	}
+
+	for i, result := range response.Results {
+		if result.Index != i || result.Status != want[i] {
+			t.Errorf("result %d: got index %d status %s, want %s", i, result.Index, result.Status, want[i])
+		}
+	}
+
+	if response.Delivered != 1 || response.Failed != 3 {
+		t.Errorf("got %d delivered and %d failed, want 1 and 3", response.Delivered, response.Failed)
+	}
+}
+
+func TestServeBatchEventsLimits(t *testing.T) {
+	server := newWebsocketServer(&App{Key: "key", MaxBatchSize: 2}, newMemoryBroker(), "node", nil)
+
+	event := `{"name":"chat","event":"event"}`
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"over the batch size", `{"batch":[` + strings.Repeat(event+",", 2) + event + `]}`, http.StatusBadRequest},
+		{"empty batch", `{"batch":[]}`, http.StatusBadRequest},
+		{"invalid JSON", `{"batch":`, http.StatusBadRequest},
+		{"at the batch size", `{"batch":[` + event + "," + event + `]}`, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		if recorder := postEvent(server, serveBatchEvents, test.body); recorder.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, recorder.Code, test.status)
+		}
+	}
+
+	// GET is not a trigger
+	recorder := httptest.NewRecorder()
+	serveBatchEvents(server, recorder, httptest.NewRequest(http.MethodGet, "/batch_events", nil))
+
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d for GET, want 405", recorder.Code)
+	}
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Directory used by the file history store when none is configured.
+	defaultHistoryDir = "history"
+
+	// Size at which a channel's log segment is closed and a new one started.
+	// It is lowered to a quarter of the size limit, as only whole segments
+	// are deleted.
+	historySegmentSize = 1 << 20
+
+	historySegmentExt = ".log"
+
+	// File of a channel's directory holding its last sequence number, saved
+	// before segments are deleted.
+	historySequenceFile = "sequence"
+)
+
+// FileHistoryStore keeps channel history on local disk, so it survives
+// restarts. Every channel has a directory of numbered, append-only segments
+// holding one JSON message per line. The oldest segments are deleted once a
+// channel's log grows past maxBytes or they only hold messages older than
+// maxAge. Reads return at most limit messages, from a cache of the last ones
+// when it holds them all.
+type FileHistoryStore struct {
+	dir         string
+	limit       int
+	maxBytes    int64
+	maxAge      time.Duration
+	segmentSize int64
+	// mu guards logs. Every channelLog has its own lock.
+	logs map[string]*channelLog
+	mu   sync.Mutex
+}
+
+// channelLog is the list of segments of a channel, oldest first, and tail,
+// the last messages appended. complete is set while tail holds every message
+// of the log. sequence is the number of the last message appended, once
+// loaded, and savedSequence the one in the sequence file. mu guards them,
+// segment files are read without it.
+type channelLog struct {
+	dir            string
+	segments       []*logSegment
+	tail           *History
+	complete       bool
+	sequence       uint64
+	savedSequence  uint64
+	sequenceLoaded bool
+	mu             sync.Mutex
+}
+
+// logSegment is a log file. first and last are the sequence numbers of its
+// first and last messages, zero until they are known.
+type logSegment struct {
+	index    int64
+	size     int64
+	modified time.Time
+	first    uint64
+	last     uint64
+}
+
+func newFileHistoryStore(dir string, limit int, maxBytes int64, maxAge time.Duration) (*FileHistoryStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	segmentSize := int64(historySegmentSize)
+	if maxBytes > 0 && maxBytes/4 < segmentSize {
+		segmentSize = maxBytes / 4
+	}
+
+	return &FileHistoryStore{
+		dir:         dir,
+		limit:       limit,
+		maxBytes:    maxBytes,
+		maxAge:      maxAge,
+		segmentSize: segmentSize,
+		logs:        make(map[string]*channelLog),
+	}, nil
+}
+
+func (store *FileHistoryStore) Append(channelName string, message *Message) error {
+	line, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+
+	channelLog, err := store.openLog(channelName)
+	if err != nil {
+		return err
+	}
+
+	channelLog.mu.Lock()
+	defer channelLog.mu.Unlock()
+
+	// Retention must know the last sequence before deleting anything
+	if err := channelLog.loadSequence(); err != nil {
+		return err
+	}
+
+	segment := channelLog.lastSegment()
+
+	// Rotate once the current segment is full
+	if segment == nil || segment.size+int64(len(line)) > store.segmentSize && segment.size > 0 {
+		index := int64(1)
+		if segment != nil {
+			index = segment.index + 1
+		}
+
+		segment = &logSegment{index: index}
+		channelLog.segments = append(channelLog.segments, segment)
+	}
+
+	if err := os.MkdirAll(channelLog.dir, 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(channelLog.segmentPath(segment), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	if _, err := file.Write(line); err != nil {
+		return err
+	}
+
+	segment.size += int64(len(line))
+	segment.modified = time.Now()
+
+	if segment.first == 0 {
+		segment.first = message.Sequence
+	}
+	segment.last = message.Sequence
+	channelLog.sequence = message.Sequence
+
+	if channelLog.tail != nil {
+		if channelLog.tail.full() {
+			channelLog.complete = false
+		}
+
+		channelLog.tail.add(message)
+	}
+
+	store.applyRetention(channelLog)
+
+	return nil
+}
+
+func (store *FileHistoryStore) Read(channelName string, request *HistoryRequest) ([]*Message, error) {
+	channelLog, err := store.openLog(channelName)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := store.limit
+	if request.Limit > 0 && (limit <= 0 || request.Limit < limit) {
+		limit = request.Limit
+	}
+
+	channelLog.mu.Lock()
+
+	if messages, ok := channelLog.readTail(request, limit); ok {
+		channelLog.mu.Unlock()
+		return messages, nil
+	}
+
+	// Segments are only appended to, so reading up to their current size
+	// doesn't need the lock
+	segments := make([]logSegment, len(channelLog.segments))
+	for i, segment := range channelLog.segments {
+		segments[i] = *segment
+	}
+
+	channelLog.mu.Unlock()
+
+	since := request.Since
+	if store.maxAge > 0 {
+		if oldest := time.Now().Add(-store.maxAge).Unix(); oldest > since {
+			since = oldest
+		}
+	}
+
+	// Read the newest segments first, until there are enough messages
+	var batches [][]*Message
+	count := 0
+
+	for i := len(segments) - 1; i >= 0 && (limit <= 0 || count < limit); i-- {
+		segment := &segments[i]
+
+		if segment.size == 0 || request.ToSequence > 0 && segment.first > request.ToSequence {
+			continue
+		}
+
+		// Older segments only hold older messages
+		if since > 0 && segment.modified.Unix() < since || segment.last > 0 && segment.last < request.FromSequence {
+			break
+		}
+
+		segmentMessages, err := readSegment(channelLog.segmentPath(segment), segment.size)
+		if err != nil {
+			return nil, err
+		}
+
+		if segment.last == 0 && len(segmentMessages) > 0 {
+			channelLog.indexSegment(segment.index, segmentMessages[0].Sequence, segmentMessages[len(segmentMessages)-1].Sequence)
+		}
+
+		var matching []*Message
+
+		for _, message := range segmentMessages {
+			if message.Timestamp >= since && request.matches(message) {
+				matching = append(matching, message)
+			}
+		}
+
+		batches = append(batches, matching)
+		count += len(matching)
+	}
+
+	messages := make([]*Message, 0, count)
+
+	for i := len(batches) - 1; i >= 0; i-- {
+		messages = append(messages, batches[i]...)
+	}
+
+	if limit > 0 && len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+
+	return messages, nil
+}
+
+func (store *FileHistoryStore) LastSequence(channelName string) (uint64, error) {
+	channelLog, err := store.openLog(channelName)
+	if err != nil {
+		return 0, err
+	}
+
+	channelLog.mu.Lock()
+	defer channelLog.mu.Unlock()
+
+	if err := channelLog.loadSequence(); err != nil {
+		return 0, err
+	}
+
+	return channelLog.sequence, nil
+}
+
+func (store *FileHistoryStore) Close() error {
+	return nil
+}
+
+// openLog returns the log of a channel, listing its segments on first use.
+func (store *FileHistoryStore) openLog(channelName string) (*channelLog, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if channelLog, ok := store.logs[channelName]; ok {
+		return channelLog, nil
+	}
+
+	channelLog := &channelLog{dir: filepath.Join(store.dir, escapePathName(channelName))}
+
+	entries, err := os.ReadDir(channelLog.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		index, err := strconv.ParseInt(strings.TrimSuffix(entry.Name(), historySegmentExt), 10, 64)
+		if err != nil || !strings.HasSuffix(entry.Name(), historySegmentExt) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		channelLog.segments = append(channelLog.segments, &logSegment{
+			index:    index,
+			size:     info.Size(),
+			modified: info.ModTime(),
+		})
+	}
+
+	sort.Slice(channelLog.segments, func(i, j int) bool {
+		return channelLog.segments[i].index < channelLog.segments[j].index
+	})
+
+	// Only an empty log is all in the tail, older messages stay on disk
+	channelLog.complete = len(channelLog.segments) == 0
+
+	if store.limit > 0 {
+		channelLog.tail = newHistory(store.limit, store.maxAge)
+	}
+
+	// Append to a new segment, never after a line cut short by a crash
+	if segment := channelLog.lastSegment(); segment != nil {
+		channelLog.segments = append(channelLog.segments, &logSegment{index: segment.index + 1, modified: time.Now()})
+	}
+
+	store.logs[channelName] = channelLog
+
+	return channelLog, nil
+}
+
+// applyRetention deletes the oldest segments of a channel that are too old or
+// over the size limit, always keeping the current one. The last sequence is
+// saved first, as it may be in a deleted segment. Callers hold the log's mu,
+// with the sequence loaded.
+func (store *FileHistoryStore) applyRetention(channelLog *channelLog) {
+	var size int64
+	for _, segment := range channelLog.segments {
+		size += segment.size
+	}
+
+	oldest := time.Now().Add(-store.maxAge)
+
+	for len(channelLog.segments) > 1 {
+		segment := channelLog.segments[0]
+
+		expired := store.maxAge > 0 && segment.modified.Before(oldest)
+		oversized := store.maxBytes > 0 && size > store.maxBytes
+
+		if !expired && !oversized {
+			return
+		}
+
+		if err := channelLog.saveSequence(); err != nil {
+			log.Printf("Error on saving history sequence %s", err)
+			return
+		}
+
+		if err := os.Remove(channelLog.segmentPath(segment)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error on removing history segment %s", err)
+			return
+		}
+
+		size -= segment.size
+		channelLog.segments = channelLog.segments[1:]
+
+		// Don't serve from the tail what is gone from disk
+		if channelLog.tail != nil && segment.last > 0 {
+			channelLog.tail.dropThrough(segment.last)
+		}
+	}
+}
+
+// readTail returns the messages matching a read from the tail, reporting
+// whether the tail holds every message the read returns. Callers hold mu.
+func (channelLog *channelLog) readTail(request *HistoryRequest, limit int) ([]*Message, bool) {
+	if channelLog.tail == nil || limit <= 0 {
+		return nil, false
+	}
+
+	tailRequest := *request
+	tailRequest.Limit = limit
+
+	messages := channelLog.tail.replay(&tailRequest)
+
+	// The tail holds the last messages, so it has all of a read that fills
+	// the limit or starts after its oldest message
+	oldest := channelLog.tail.oldest()
+
+	covered := channelLog.complete || len(messages) == limit ||
+		oldest != nil && request.FromSequence > 0 && oldest.Sequence <= request.FromSequence
+
+	return messages, covered
+}
+
+// indexSegment records the sequence numbers of a segment listed on open, once
+// it has been read.
+func (channelLog *channelLog) indexSegment(index int64, first uint64, last uint64) {
+	channelLog.mu.Lock()
+	defer channelLog.mu.Unlock()
+
+	for _, segment := range channelLog.segments {
+		if segment.index == index && segment.last == 0 {
+			segment.first = first
+			segment.last = last
+		}
+	}
+}
+
+// loadSequence reads the last sequence number of the log once, the greater of
+// the saved one and the last one on disk. Callers hold mu.
+func (channelLog *channelLog) loadSequence() error {
+	if channelLog.sequenceLoaded {
+		return nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(channelLog.dir, historySequenceFile))
+
+	if err == nil {
+		channelLog.savedSequence, _ = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	sequence := channelLog.savedSequence
+
+	// The newest segment holding a message has the last one
+	for i := len(channelLog.segments) - 1; i >= 0; i-- {
+		segment := channelLog.segments[i]
+
+		messages, err := readSegment(channelLog.segmentPath(segment), segment.size)
+		if err != nil {
+			return err
+		}
+
+		if len(messages) > 0 {
+			if last := messages[len(messages)-1].Sequence; last > sequence {
+				sequence = last
+			}
+
+			break
+		}
+	}
+
+	if sequence > channelLog.sequence {
+		channelLog.sequence = sequence
+	}
+
+	channelLog.sequenceLoaded = true
+
+	return nil
+}
+
+// saveSequence writes the last sequence number to the sequence file, if it
+// changed. Callers hold mu.
+func (channelLog *channelLog) saveSequence() error {
+	if channelLog.sequence <= channelLog.savedSequence {
+		return nil
+	}
+
+	path := filepath.Join(channelLog.dir, historySequenceFile)
+
+	// Write a new file and rename it over the old one, so it is never half written
+	if err := os.WriteFile(path+".tmp", []byte(strconv.FormatUint(channelLog.sequence, 10)), 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	channelLog.savedSequence = channelLog.sequence
+
+	return nil
+}
+
+func (channelLog *channelLog) lastSegment() *logSegment {
+	if len(channelLog.segments) == 0 {
+		return nil
+	}
+
+	return channelLog.segments[len(channelLog.segments)-1]
+}
+
+func (channelLog *channelLog) segmentPath(segment *logSegment) string {
+	return filepath.Join(channelLog.dir, fmt.Sprintf("%020d%s", segment.index, historySegmentExt))
+}
+
+// readSegment reads the messages in the first size bytes of a segment. A line
+// cut short by a crash is skipped.
+func readSegment(path string, size int64) ([]*Message, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	defer file.Close()
+
+	reader := bufio.NewReader(io.LimitReader(file, size))
+
+	var messages []*Message
+
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		if err == io.EOF {
+			return messages, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		var message Message
+
+		if err := json.Unmarshal(line, &message); err != nil {
+			log.Printf("Error on unmarshal history message in %s %s", path, err)
+			continue
+		}
+
+		messages = append(messages, &message)
+	}
+}
+
+// escapePathName makes a channel or app name safe to use as a directory name.
+func escapePathName(name string) string {
+	return strings.ReplaceAll(url.PathEscape(name), ".", "%2E")
+}
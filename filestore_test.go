@@ -0,0 +1,303 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestFileStore(t *testing.T, dir string, limit int, maxBytes int64, maxAge time.Duration) *FileHistoryStore {
+	store, err := newFileHistoryStore(dir, limit, maxBytes, maxAge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+func appendMessages(t *testing.T, store HistoryStore, channelName string, messages []*Message) {
+	for _, message := range messages {
+		if err := store.Append(channelName, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readSequences(t *testing.T, store HistoryStore, channelName string, request *HistoryRequest) []uint64 {
+	messages, err := store.Read(channelName, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sequences(messages)
+}
+
+func segmentFiles(t *testing.T, store *FileHistoryStore, channelName string) []string {
+	files, err := filepath.Glob(filepath.Join(store.dir, escapePathName(channelName), "*"+historySegmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+func TestFileHistoryStoreRead(t *testing.T) {
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name    string
+		limit   int
+		count   int
+		request HistoryRequest
+		want    []uint64
+	}{
+		{"all", 10, 3, HistoryRequest{}, []uint64{1, 2, 3}},
+		{"store limit keeps the last", 3, 5, HistoryRequest{}, []uint64{3, 4, 5}},
+		{"request limit", 10, 5, HistoryRequest{Limit: 2}, []uint64{4, 5}},
+		{"request limit over the store limit", 2, 5, HistoryRequest{Limit: 4}, []uint64{4, 5}},
+		{"from sequence", 10, 5, HistoryRequest{FromSequence: 4}, []uint64{4, 5}},
+		{"sequence range", 10, 5, HistoryRequest{FromSequence: 2, ToSequence: 3}, []uint64{2, 3}},
+		{"since", 10, 3, HistoryRequest{Since: now + 1}, []uint64{}},
+		{"no limit", 0, 5, HistoryRequest{}, []uint64{1, 2, 3, 4, 5}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			store := newTestFileStore(t, dir, test.limit, 0, 0)
+			appendMessages(t, store, "channel", historyMessages(test.count, now))
+
+			if got := readSequences(t, store, "channel", &test.request); !equalSequences(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+
+			// The same read from disk, after a restart
+			reopened := newTestFileStore(t, dir, test.limit, 0, 0)
+
+			if got := readSequences(t, reopened, "channel", &test.request); !equalSequences(got, test.want) {
+				t.Errorf("after restart got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFileHistoryStoreRotation(t *testing.T) {
+	store := newTestFileStore(t, t.TempDir(), 1000, 0, 0)
+	store.segmentSize = 300
+
+	appendMessages(t, store, "channel", historyMessages(20, time.Now().Unix()))
+
+	if files := segmentFiles(t, store, "channel"); len(files) < 3 {
+		t.Fatalf("got %d segments, want the log rotated", len(files))
+	}
+
+	for _, file := range segmentFiles(t, store, "channel") {
+		if info, _ := os.Stat(file); info.Size() > store.segmentSize {
+			t.Errorf("segment %s holds %d bytes, over the segment size", file, info.Size())
+		}
+	}
+
+	if got := readSequences(t, store, "channel", &HistoryRequest{FromSequence: 5, ToSequence: 7}); !equalSequences(got, []uint64{5, 6, 7}) {
+		t.Errorf("got %v, want [5 6 7]", got)
+	}
+}
+
+func TestFileHistoryStoreSizeRetention(t *testing.T) {
+	store := newTestFileStore(t, t.TempDir(), 1000, 1200, 0)
+
+	appendMessages(t, store, "channel", historyMessages(100, time.Now().Unix()))
+
+	var size int64
+	for _, file := range segmentFiles(t, store, "channel") {
+		info, _ := os.Stat(file)
+		size += info.Size()
+	}
+
+	if size > 1200 {
+		t.Errorf("log holds %d bytes, over the size limit", size)
+	}
+
+	got := readSequences(t, store, "channel", &HistoryRequest{})
+
+	if len(got) == 0 || got[len(got)-1] != 100 {
+		t.Fatalf("got %v, want the last messages", got)
+	}
+
+	if got[0] == 1 {
+		t.Errorf("the oldest messages were kept")
+	}
+
+	// The tail cache serves no more than what is left on disk
+	reopened := newTestFileStore(t, store.dir, 1000, 1200, 0)
+
+	if fromDisk := readSequences(t, reopened, "channel", &HistoryRequest{}); !equalSequences(got, fromDisk) {
+		t.Errorf("got %v from the cache, %v from disk", got, fromDisk)
+	}
+}
+
+func TestFileHistoryStoreAgeRetention(t *testing.T) {
+	dir := t.TempDir()
+
+	store := newTestFileStore(t, dir, 100, 0, time.Minute)
+	store.segmentSize = 300
+
+	old := time.Now().Add(-2 * time.Minute)
+	appendMessages(t, store, "channel", historyMessages(10, old.Unix()))
+
+	// Age the segments written so far
+	for _, file := range segmentFiles(t, store, "channel") {
+		os.Chtimes(file, old, old)
+	}
+
+	reopened := newTestFileStore(t, dir, 100, 0, time.Minute)
+
+	if got := readSequences(t, reopened, "channel", &HistoryRequest{}); len(got) != 0 {
+		t.Errorf("got %v, want expired messages dropped", got)
+	}
+
+	recent := historyMessages(12, time.Now().Unix())[10:]
+	appendMessages(t, reopened, "channel", recent)
+
+	if got := readSequences(t, reopened, "channel", &HistoryRequest{}); !equalSequences(got, []uint64{11, 12}) {
+		t.Errorf("got %v, want [11 12]", got)
+	}
+
+	// Expired segments are deleted as messages are appended
+	if files := segmentFiles(t, reopened, "channel"); len(files) > 1 {
+		t.Errorf("got %d segments, want the expired ones deleted", len(files))
+	}
+}
+
+func TestFileHistoryStoreReadsPastTheCache(t *testing.T) {
+	dir := t.TempDir()
+
+	store := newTestFileStore(t, dir, 5, 0, 0)
+	appendMessages(t, store, "channel", historyMessages(5, time.Now().Unix()))
+
+	// After a restart the cache only holds the new messages
+	reopened := newTestFileStore(t, dir, 5, 0, 0)
+	appendMessages(t, reopened, "channel", historyMessages(8, time.Now().Unix())[5:])
+
+	tests := []struct {
+		request HistoryRequest
+		want    []uint64
+	}{
+		{HistoryRequest{}, []uint64{4, 5, 6, 7, 8}},
+		{HistoryRequest{Limit: 2}, []uint64{7, 8}},
+		{HistoryRequest{FromSequence: 2, ToSequence: 3}, []uint64{2, 3}},
+		{HistoryRequest{FromSequence: 7}, []uint64{7, 8}},
+	}
+
+	for _, test := range tests {
+		if got := readSequences(t, reopened, "channel", &test.request); !equalSequences(got, test.want) {
+			t.Errorf("%+v: got %v, want %v", test.request, got, test.want)
+		}
+	}
+}
+
+func TestFileHistoryStoreSkipsTruncatedLine(t *testing.T) {
+	dir := t.TempDir()
+
+	store := newTestFileStore(t, dir, 10, 0, 0)
+	appendMessages(t, store, "channel", historyMessages(2, time.Now().Unix()))
+
+	files := segmentFiles(t, store, "channel")
+
+	file, err := os.OpenFile(files[len(files)-1], os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.WriteString(`{"action":"send_message","seq`)
+	file.Close()
+
+	reopened := newTestFileStore(t, dir, 10, 0, 0)
+	appendMessages(t, reopened, "channel", historyMessages(3, time.Now().Unix())[2:])
+
+	if got := readSequences(t, reopened, "channel", &HistoryRequest{}); !equalSequences(got, []uint64{1, 2, 3}) {
+		t.Errorf("got %v, want [1 2 3]", got)
+	}
+}
+
+func TestFileHistoryStoreConcurrentChannels(t *testing.T) {
+	store := newTestFileStore(t, t.TempDir(), 10, 0, 0)
+	store.segmentSize = 300
+
+	done := make(chan bool)
+
+	for _, channelName := range []string{"a", "b", "c"} {
+		go func(channelName string) {
+			for _, message := range historyMessages(50, time.Now().Unix()) {
+				store.Append(channelName, message)
+				store.Read(channelName, &HistoryRequest{FromSequence: 1})
+			}
+
+			done <- true
+		}(channelName)
+	}
+
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+
+	for _, channelName := range []string{"a", "b", "c"} {
+		if got := readSequences(t, store, channelName, &HistoryRequest{Limit: 2}); !equalSequences(got, []uint64{49, 50}) {
+			t.Errorf("channel %s: got %v, want [49 50]", channelName, got)
+		}
+	}
+}
+
+func TestEscapePathName(t *testing.T) {
+	tests := map[string]string{
+		"chat":         "chat",
+		"..":           "%2E%2E",
+		"private-a/b":  "private-a%2Fb",
+		"presence-a.b": "presence-a%2Eb",
+	}
+
+	for name, want := range tests {
+		if got := escapePathName(name); got != want {
+			t.Errorf("escapePathName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestFileHistoryStoreLastSequence(t *testing.T) {
+	dir := t.TempDir()
+
+	store := newTestFileStore(t, dir, 100, 0, time.Minute)
+	store.segmentSize = 300
+
+	old := time.Now().Add(-2 * time.Minute)
+	appendMessages(t, store, "channel", historyMessages(5, old.Unix()))
+
+	for _, file := range segmentFiles(t, store, "channel") {
+		os.Chtimes(file, old, old)
+	}
+
+	// Messages too old to be read still number the channel
+	reopened := newTestFileStore(t, dir, 100, 0, time.Minute)
+
+	if got := readSequences(t, reopened, "channel", &HistoryRequest{}); len(got) != 0 {
+		t.Fatalf("got %v, want expired messages dropped", got)
+	}
+
+	if sequence, err := reopened.LastSequence("channel"); err != nil || sequence != 5 {
+		t.Fatalf("got %d, %v, want 5", sequence, err)
+	}
+
+	// Deleting the expired segments saves the last sequence first
+	appendMessages(t, reopened, "channel", historyMessages(6, time.Now().Unix())[5:])
+
+	for _, file := range segmentFiles(t, reopened, "channel") {
+		os.Remove(file)
+	}
+
+	restarted := newTestFileStore(t, dir, 100, 0, time.Minute)
+
+	if sequence, err := restarted.LastSequence("channel"); err != nil || sequence != 6 {
+		t.Errorf("got %d, %v, want 6 from the sequence file", sequence, err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Subprotocols a client can ask for in Sec-WebSocket-Protocol. With
+// JSONSubprotocol, or none, every message is its own text frame. With
+// JSONBatchSubprotocol every frame is a JSON array of the messages queued
+// when it was written. Binary codecs write a frame per message.
+const JSONSubprotocol = "gosocks.json"
+const JSONBatchSubprotocol = "gosocks.json-batch"
+
+var (
+	batchStart     = []byte{'['}
+	batchSeparator = []byte{','}
+	batchEnd       = []byte{']'}
+)
+
+// writeMessages writes encoded messages to the connection, as one frame each
+// in the connection's codec or as a single batch frame when batching was
+// negotiated.
+func (client *Client) writeMessages(messages [][]byte) error {
+	if !client.features.Batching {
+		for _, message := range messages {
+			frame, err := client.codec.Encode(message)
+			if err != nil {
+				log.Printf("Error on encoding %s message %s", client.codec.Name(), err)
+				continue
+			}
+
+			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := client.conn.WriteMessage(client.codec.FrameType(), frame); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if len(messages) == 0 {
+		return nil
+	}
+
+	client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+
+	w, err := client.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+
+	w.Write(batchStart)
+
+	for i, message := range messages {
+		if i > 0 {
+			w.Write(batchSeparator)
+		}
+
+		w.Write(message)
+	}
+
+	w.Write(batchEnd)
+
+	return w.Close()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// newWritePumpTestConn opens a websocket to a client whose write pump starts
+// with the messages already queued, returning the other end.
+func newWritePumpTestConn(t *testing.T, subprotocol string, messages [][]byte) *websocket.Conn {
+	wsServer := newWebsocketServer(&App{Key: "key"}, newMemoryBroker(), "node", nil)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		client := newClient(conn, wsServer, nil)
+		client.features = negotiatedFeatures(wsServer.app, r, conn)
+		client.codec = codecFor(conn.Subprotocol())
+
+		for _, message := range messages {
+			client.send <- message
+		}
+
+		go client.writePump()
+	}))
+	t.Cleanup(server.Close)
+
+	var subprotocols []string
+	if len(subprotocol) > 0 {
+		subprotocols = append(subprotocols, subprotocol)
+	}
+
+	return dialWs(t, server, "", false, subprotocols...)
+}
+
+// queuedMessages returns count messages numbered from 1.
+func queuedMessages(count int) [][]byte {
+	messages := make([][]byte, 0, count)
+
+	for i := 1; i <= count; i++ {
+		messages = append(messages, (&Message{Action: SendMessageAction, Event: "event", Sequence: uint64(i)}).encode())
+	}
+
+	return messages
+}
+
+func TestWritePumpFramePerMessage(t *testing.T) {
+	for _, subprotocol := range []string{"", JSONSubprotocol, MsgpackSubprotocol, ProtobufSubprotocol} {
+		t.Run("subprotocol "+subprotocol, func(t *testing.T) {
+			conn := newWritePumpTestConn(t, subprotocol, queuedMessages(3))
+			codec := codecFor(subprotocol)
+
+			for i := 1; i <= 3; i++ {
+				frameType, frame := readFrame(t, conn)
+
+				if frameType != codec.FrameType() {
+					t.Errorf("got frame type %d, want %d", frameType, codec.FrameType())
+				}
+
+				decoded, err := codec.Decode(frame)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var message Message
+				if err := json.Unmarshal(decoded, &message); err != nil {
+					t.Fatalf("got %s, want a single message: %s", decoded, err)
+				}
+
+				if message.Sequence != uint64(i) {
+					t.Errorf("got message %d, want %d", message.Sequence, i)
+				}
+			}
+		})
+	}
+}
+
+func TestWritePumpBatch(t *testing.T) {
+	conn := newWritePumpTestConn(t, JSONBatchSubprotocol, queuedMessages(3))
+
+	frameType, frame := readFrame(t, conn)
+
+	if frameType != websocket.TextMessage {
+		t.Errorf("got frame type %d, want text", frameType)
+	}
+
+	var batch []Message
+	if err := json.Unmarshal(frame, &batch); err != nil {
+		t.Fatalf("got %s, want a JSON array: %s", frame, err)
+	}
+
+	if len(batch) != 3 {
+		t.Fatalf("got %d messages in the batch, want 3", len(batch))
+	}
+
+	for i, message := range batch {
+		if message.Sequence != uint64(i+1) {
+			t.Errorf("got message %d at %d, want them in order", message.Sequence, i)
+		}
+	}
+
+	// A single queued message is still an array
+	conn = newWritePumpTestConn(t, JSONBatchSubprotocol, queuedMessages(1))
+
+	if _, frame := readFrame(t, conn); string(frame) != "["+string(queuedMessages(1)[0])+"]" {
+		t.Errorf("got %s, want a batch of one", frame)
+	}
+}
+
+func TestWritePumpBatchEmpty(t *testing.T) {
+	client := &Client{features: Features{Batching: true}}
+
+	if err := client.writeMessages(nil); err != nil {
+		t.Errorf("got %v writing no messages, want nothing written", err)
+	}
+}
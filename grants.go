@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"path"
+)
+
+const GrantSubscribe = "subscribe"
+const GrantPublish = "publish"
+
+// Claim listing the channels a connection token grants access to.
+const channelsClaim = "channels"
+
+var errSubscribeDenied = errors.New("token does not grant subscribe on this channel")
+var errPublishDenied = errors.New("token does not grant publish on this channel")
+
+// ChannelGrant allows access to every channel whose name matches Pattern,
+// using path.Match syntax (e.g. "chat-*").
+type ChannelGrant struct {
+	Pattern   string `json:"pattern"`
+	Subscribe bool   `json:"subscribe"`
+	Publish   bool   `json:"publish"`
+}
+
+// parseChannelGrants reads the channels claim. A nil slice means the token
+// carries no channel restrictions.
+func parseChannelGrants(claims *Claims) []ChannelGrant {
+	if claims == nil {
+		return nil
+	}
+
+	if _, ok := claims.raw[channelsClaim]; !ok {
+		return nil
+	}
+
+	var grants []ChannelGrant
+
+	// A malformed claim grants nothing rather than everything
+	if !claims.Get(channelsClaim, &grants) || grants == nil {
+		log.Printf("Malformed %s claim in token for %s", channelsClaim, claims.Subject)
+		return []ChannelGrant{}
+	}
+
+	return grants
+}
+
+// isGranted reports whether the client's token allows the permission on the
+// named channel.
+func (client *Client) isGranted(channelName string, permission string) bool {
+	if client.grants == nil {
+		return true
+	}
+
+	for _, grant := range client.grants {
+		if matched, err := path.Match(grant.Pattern, channelName); err != nil || !matched {
+			continue
+		}
+
+		switch permission {
+		case GrantSubscribe:
+			if grant.Subscribe {
+				return true
+			}
+		case GrantPublish:
+			if grant.Publish {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestIsGranted(t *testing.T) {
+	grants := []ChannelGrant{
+		{Pattern: "chat-*", Subscribe: true, Publish: true},
+		{Pattern: "news", Subscribe: true},
+		{Pattern: "private-room-?", Publish: true},
+		{Pattern: "[", Subscribe: true, Publish: true},
+	}
+
+	tests := []struct {
+		name       string
+		grants     []ChannelGrant
+		channel    string
+		permission string
+		granted    bool
+	}{
+		{"no claim", nil, "anything", GrantPublish, true},
+		{"empty claim", []ChannelGrant{}, "chat-a", GrantSubscribe, false},
+		{"wildcard subscribe", grants, "chat-a", GrantSubscribe, true},
+		{"wildcard publish", grants, "chat-a", GrantPublish, true},
+		{"wildcard needs suffix", grants, "chat", GrantSubscribe, false},
+		{"wildcard stops at slash", grants, "chat-a/b", GrantSubscribe, false},
+		{"exact subscribe", grants, "news", GrantSubscribe, true},
+		{"exact without publish", grants, "news", GrantPublish, false},
+		{"exact only", grants, "news-sport", GrantSubscribe, false},
+		{"single character", grants, "private-room-1", GrantPublish, true},
+		{"single character without subscribe", grants, "private-room-1", GrantSubscribe, false},
+		{"single character only", grants, "private-room-10", GrantPublish, false},
+		{"malformed pattern", grants, "[", GrantSubscribe, false},
+		{"unknown permission", grants, "chat-a", "admin", false},
+		{"no match", grants, "other", GrantSubscribe, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &Client{grants: test.grants}
+
+			if granted := client.isGranted(test.channel, test.permission); granted != test.granted {
+				t.Errorf("got %v, want %v", granted, test.granted)
+			}
+		})
+	}
+}
+
+func TestParseChannelGrants(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims *Claims
+		grants []ChannelGrant
+	}{
+		{"no claims", nil, nil},
+		{"no channels claim", &Claims{raw: map[string]json.RawMessage{}}, nil},
+		{"grants", &Claims{raw: map[string]json.RawMessage{
+			channelsClaim: json.RawMessage(`[{"pattern":"chat-*","subscribe":true}]`),
+		}}, []ChannelGrant{{Pattern: "chat-*", Subscribe: true}}},
+		{"malformed", &Claims{raw: map[string]json.RawMessage{
+			channelsClaim: json.RawMessage(`"chat-*"`),
+		}}, []ChannelGrant{}},
+		{"null", &Claims{raw: map[string]json.RawMessage{
+			channelsClaim: json.RawMessage(`null`),
+		}}, []ChannelGrant{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			grants := parseChannelGrants(test.claims)
+
+			if (grants == nil) != (test.grants == nil) || len(grants) != len(test.grants) {
+				t.Fatalf("got %v, want %v", grants, test.grants)
+			}
+
+			for i := range grants {
+				if grants[i] != test.grants[i] {
+					t.Errorf("got %v, want %v", grants[i], test.grants[i])
+				}
+			}
+		})
+	}
+}
+
+// nextError returns the data of the next frame sent to the client, failing
+// unless it is an error.
+func nextError(t *testing.T, client *Client) ErrorData {
+	t.Helper()
+
+	var message Message
+	var data ErrorData
+
+	select {
+	case frame := <-client.send:
+		json.Unmarshal(frame, &message)
+	default:
+	}
+
+	if message.Action != ErrorAction {
+		t.Fatalf("got action %q, want an error", message.Action)
+	}
+
+	json.Unmarshal(message.Data, &data)
+
+	return data
+}
+
+func TestJoinRequiresSubscribeGrant(t *testing.T) {
+	server := newWebsocketServer(&App{Key: "key"}, newMemoryBroker(), "node", nil)
+
+	client := newTestRecipient(server)
+	client.channels = make(map[*Channel]bool)
+	client.members = make(map[*Channel]*Member)
+	client.grants = []ChannelGrant{{Pattern: "news", Subscribe: true}, {Pattern: "chat", Publish: true}}
+
+	client.handleNewMessage([]byte(`{"action":"join_channel","name":"chat"}`))
+
+	if data := nextError(t, client); data.Code != ErrorCodeForbidden || data.Message != errSubscribeDenied.Error() {
+		t.Errorf("got %+v, want the subscribe to be denied", data)
+	}
+
+	if server.findChannelByName("chat") != nil {
+		t.Error("got a channel created by a denied join")
+	}
+
+	client.handleNewMessage([]byte(`{"action":"join_channel","name":"news"}`))
+
+	if action := nextFrame(client); action != ChannelJoinedAction {
+		t.Errorf("got %q, want %s", action, ChannelJoinedAction)
+	}
+}
+
+func TestPublishRequiresPublishGrant(t *testing.T) {
+	server := newWebsocketServer(&App{Key: "key", ClientEvents: true}, newMemoryBroker(), "node", nil)
+	channel := server.createChannel("private-chat", true)
+
+	client := newTestRecipient(server)
+	client.channels = map[*Channel]bool{channel: true}
+	client.grants = []ChannelGrant{{Pattern: "private-*", Subscribe: true}}
+
+	client.handleNewMessage([]byte(`{"action":"send_message","name":"private-chat","event":"client-typing"}`))
+
+	if data := nextError(t, client); data.Code != ErrorCodeForbidden || data.Message != errPublishDenied.Error() {
+		t.Errorf("got %+v, want the publish to be denied", data)
+	}
+
+	client.grants = append(client.grants, ChannelGrant{Pattern: "private-chat", Publish: true})
+
+	if _, _, err := client.authorizePublish("private-chat"); err != nil {
+		t.Errorf("got %v, want the publish to be granted", err)
+	}
+}
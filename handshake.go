@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const ConnectionEstablishedAction = "connection_established"
+
+// ProtocolVersion is bumped whenever the message format changes in a way
+// client SDKs need to know about.
+const ProtocolVersion = 3
+
+// ConnectionData is the payload of the connection_established event, telling
+// a client the socket id it can pass to the server API as socket_id and what
+// the server supports on this connection.
+type ConnectionData struct {
+	SocketID        string   `json:"socket_id"`
+	ProtocolVersion int      `json:"protocol_version"`
+	ActivityTimeout int      `json:"activity_timeout"`
+	MaxMessageSize  int      `json:"max_message_size"`
+	MaxDataSize     int      `json:"max_data_size"`
+	Features        Features `json:"features"`
+	// ResumeToken lets the client resume this session on a new connection,
+	// Resumed is set when it just did.
+	ResumeToken string `json:"resume_token,omitempty"`
+	Resumed     bool   `json:"resumed,omitempty"`
+	// StreamToken is sent with every frame posted to an event stream.
+	StreamToken string `json:"stream_token,omitempty"`
+}
+
+// Features lists the optional capabilities enabled for a connection.
+type Features struct {
+	Compression    bool `json:"compression"`
+	BinaryEncoding bool `json:"binary_encoding"`
+	Resume         bool `json:"resume"`
+	Batching       bool `json:"batching"`
+	// Encoding is the codec of the frames, json unless a binary one was
+	// negotiated.
+	Encoding string `json:"encoding"`
+}
+
+// negotiatedFeatures returns the features enabled for an upgrade request and
+// the connection it was upgraded to.
+func negotiatedFeatures(app *App, r *http.Request, conn *websocket.Conn) Features {
+	features := Features{
+		Compression: upgrader.EnableCompression && strings.Contains(r.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate"),
+		Resume:      app.ResumeGracePeriod > 0,
+		Batching:    conn.Subprotocol() == JSONBatchSubprotocol,
+	}
+
+	codec := codecFor(conn.Subprotocol())
+	features.BinaryEncoding = codec.FrameType() == websocket.BinaryMessage
+	features.Encoding = codec.Name()
+
+	return features
+}
+
+// notifyConnectionEstablished sends the first frame of every connection.
+func (client *Client) notifyConnectionEstablished(features Features) {
+	client.send <- client.connectionEstablished(features, false).encode()
+}
+
+// connectionEstablished builds the handshake of a new or resumed connection,
+// issuing a new resume token when resume is enabled.
+func (client *Client) connectionEstablished(features Features, resumed bool) *Message {
+	connection := ConnectionData{
+		SocketID:        client.GetId(),
+		ProtocolVersion: ProtocolVersion,
+		ActivityTimeout: int(pongWait / time.Second),
+		MaxMessageSize:  maxMessageSize,
+		MaxDataSize:     client.wsServer.app.maxDataSize(),
+		Features:        features,
+		Resumed:         resumed,
+		StreamToken:     client.streamToken,
+	}
+
+	if features.Resume {
+		client.resumeToken = uuid.New().String()
+		connection.ResumeToken = client.resumeToken
+	}
+
+	data, err := json.Marshal(connection)
+
+	if err != nil {
+		log.Println(err)
+	}
+
+	return &Message{
+		Action:    ConnectionEstablishedAction,
+		Event:     ConnectionEstablishedAction,
+		Data:      data,
+		Timestamp: time.Now().Unix(),
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newWsTestServer(t *testing.T, app *App) (*WsServer, *httptest.Server) {
+	wsServer := newWebsocketServer(app, newMemoryBroker(), "node", nil)
+	app.server = wsServer
+
+	go wsServer.Run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(wsServer, w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return wsServer, server
+}
+
+// dialWs opens a websocket on the test server, asking for the subprotocols.
+func dialWs(t *testing.T, server *httptest.Server, query string, compression bool, subprotocols ...string) *websocket.Conn {
+	t.Helper()
+
+	dialer := websocket.Dialer{Subprotocols: subprotocols, EnableCompression: compression}
+
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// readFrame returns the type and payload of the next frame on the connection.
+func readFrame(t *testing.T, conn *websocket.Conn) (int, []byte) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	frameType, frame, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return frameType, frame
+}
+
+// readConnection reads the handshake, failing unless it is the next frame, and
+// returns it with the type of its frame.
+func readConnection(t *testing.T, conn *websocket.Conn) (int, ConnectionData) {
+	t.Helper()
+
+	frameType, frame := readFrame(t, conn)
+	decoded, err := codecFor(conn.Subprotocol()).Decode(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Batched frames hold an array of messages, the handshake comes first
+	if conn.Subprotocol() == JSONBatchSubprotocol {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(decoded, &batch); err != nil || len(batch) == 0 {
+			t.Fatalf("got %s, want a batch", decoded)
+		}
+
+		decoded = batch[0]
+	}
+
+	var message Message
+	if err := json.Unmarshal(decoded, &message); err != nil {
+		t.Fatal(err)
+	}
+
+	if message.Action != ConnectionEstablishedAction {
+		t.Fatalf("got %q as the first frame, want %s", message.Action, ConnectionEstablishedAction)
+	}
+
+	var connection ConnectionData
+	if err := json.Unmarshal(message.Data, &connection); err != nil {
+		t.Fatal(err)
+	}
+
+	return frameType, connection
+}
+
+func TestConnectionEstablished(t *testing.T) {
+	tests := []struct {
+		name        string
+		app         *App
+		subprotocol string
+		compression bool
+		frameType   int
+		features    Features
+	}{
+		{"default", &App{}, "", false, websocket.TextMessage, Features{Encoding: "json"}},
+		{"json", &App{}, JSONSubprotocol, false, websocket.TextMessage, Features{Encoding: "json"}},
+		{"batching", &App{}, JSONBatchSubprotocol, false, websocket.TextMessage, Features{Batching: true, Encoding: "json"}},
+		{"msgpack", &App{}, MsgpackSubprotocol, false, websocket.BinaryMessage, Features{BinaryEncoding: true, Encoding: "msgpack"}},
+		{"protobuf", &App{}, ProtobufSubprotocol, false, websocket.BinaryMessage, Features{BinaryEncoding: true, Encoding: "protobuf"}},
+		{"compression", &App{}, "", true, websocket.TextMessage, Features{Compression: true, Encoding: "json"}},
+		{"resume", &App{ResumeGracePeriod: 30}, "", false, websocket.TextMessage, Features{Resume: true, Encoding: "json"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.app.Key = "key"
+			wsServer, server := newWsTestServer(t, test.app)
+
+			var subprotocols []string
+			if len(test.subprotocol) > 0 {
+				subprotocols = append(subprotocols, test.subprotocol)
+			}
+
+			conn := dialWs(t, server, "", test.compression, subprotocols...)
+
+			if conn.Subprotocol() != test.subprotocol {
+				t.Fatalf("got subprotocol %q, want %q", conn.Subprotocol(), test.subprotocol)
+			}
+
+			frameType, connection := readConnection(t, conn)
+
+			if frameType != test.frameType {
+				t.Errorf("got frame type %d, want %d", frameType, test.frameType)
+			}
+
+			if connection.Features != test.features {
+				t.Errorf("got features %+v, want %+v", connection.Features, test.features)
+			}
+
+			if len(connection.SocketID) == 0 || connection.ProtocolVersion != ProtocolVersion {
+				t.Errorf("got %+v, want a socket id and protocol version %d", connection, ProtocolVersion)
+			}
+
+			if connection.MaxDataSize != wsServer.app.maxDataSize() {
+				t.Errorf("got max data size %d, want %d", connection.MaxDataSize, wsServer.app.maxDataSize())
+			}
+
+			if test.features.Resume != (len(connection.ResumeToken) > 0) {
+				t.Errorf("got resume token %q with resume %v", connection.ResumeToken, test.features.Resume)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// Interval between heartbeats published by every node.
+	heartbeatPeriod = 5 * time.Second
+
+	// A node missing heartbeats for this long is considered gone.
+	nodeTimeout = 3 * heartbeatPeriod
+)
+
+// nodesTopic is shared by every node of the cluster, whatever app it serves.
+const nodesTopic = "gosocks:nodes"
+
+// NodeMonitor tracks the other gosocks nodes through heartbeats published on
+// the broker, so presence can be resynced with nodes that join and cleaned up
+// after nodes that stop heartbeating. A node restarting with the same id
+// leaves and joins again, as its users went away with the old process.
+type NodeMonitor struct {
+	broker       Broker
+	nodeId       string
+	started      int64
+	nodes        map[string]*nodeHeartbeat
+	onNodeJoined func(node string)
+	onNodeLeft   func(node string, leader bool)
+	mu           sync.Mutex
+}
+
+type nodeHeartbeat struct {
+	started int64
+	seen    time.Time
+}
+
+func newNodeMonitor(broker Broker, nodeId string) *NodeMonitor {
+	return &NodeMonitor{
+		broker:  broker,
+		nodeId:  nodeId,
+		started: time.Now().UnixNano(),
+		nodes:   make(map[string]*nodeHeartbeat),
+	}
+}
+
+// OnNodeJoined registers a callback for the first heartbeat of a node.
+func (monitor *NodeMonitor) OnNodeJoined(callback func(node string)) {
+	monitor.mu.Lock()
+	monitor.onNodeJoined = callback
+	monitor.mu.Unlock()
+}
+
+// OnNodeLeft registers a callback for a node that stopped heartbeating or
+// restarted. leader is set on the one surviving node that cleans up after it.
+func (monitor *NodeMonitor) OnNodeLeft(callback func(node string, leader bool)) {
+	monitor.mu.Lock()
+	monitor.onNodeLeft = callback
+	monitor.mu.Unlock()
+}
+
+// Run publishes this node's heartbeat and expires silent nodes.
+func (monitor *NodeMonitor) Run() {
+	if err := monitor.broker.Subscribe(nodesTopic, monitor.receiveHeartbeat); err != nil {
+		log.Printf("Error on subscribing to node heartbeats %s", err)
+	}
+
+	ticker := time.NewTicker(heartbeatPeriod)
+	defer ticker.Stop()
+
+	heartbeat, _ := json.Marshal(&BrokerEnvelope{Node: monitor.nodeId, Kind: BrokerHeartbeat, Started: monitor.started})
+
+	for {
+		if _, err := monitor.broker.Publish(nodesTopic, heartbeat); err != nil {
+			log.Printf("Error on publishing node heartbeat %s", err)
+		}
+
+		monitor.expireNodes()
+
+		<-ticker.C
+	}
+}
+
+func (monitor *NodeMonitor) receiveHeartbeat(payload []byte) {
+	envelope := decodeEnvelope(monitor.nodeId, payload)
+
+	if envelope == nil || envelope.Kind != BrokerHeartbeat {
+		return
+	}
+
+	monitor.mu.Lock()
+	previous, known := monitor.nodes[envelope.Node]
+	monitor.nodes[envelope.Node] = &nodeHeartbeat{started: envelope.Started, seen: time.Now()}
+	joined, left := monitor.onNodeJoined, monitor.onNodeLeft
+	leader := monitor.isLeader(envelope.Node)
+	monitor.mu.Unlock()
+
+	if known && previous.started == envelope.Started {
+		return
+	}
+
+	log.Printf("Node %s joined", envelope.Node)
+
+	// Leave and join run in order, a restarted node's users are gone first
+	go func() {
+		if known && left != nil {
+			left(envelope.Node, leader)
+		}
+
+		if joined != nil {
+			joined(envelope.Node)
+		}
+	}()
+}
+
+func (monitor *NodeMonitor) expireNodes() {
+	var expired []string
+
+	monitor.mu.Lock()
+	for node, heartbeat := range monitor.nodes {
+		if time.Since(heartbeat.seen) > nodeTimeout {
+			delete(monitor.nodes, node)
+			expired = append(expired, node)
+		}
+	}
+	callback := monitor.onNodeLeft
+	leader := monitor.isLeader("")
+	monitor.mu.Unlock()
+
+	for _, node := range expired {
+		log.Printf("Node %s stopped heartbeating", node)
+
+		if callback != nil {
+			go callback(node, leader)
+		}
+	}
+}
+
+// isLeader reports whether this node has the lowest id of the live nodes,
+// leaving out the node that left. Every surviving node sees the same live
+// nodes, so exactly one of them leads. Callers hold mu.
+func (monitor *NodeMonitor) isLeader(left string) bool {
+	for node := range monitor.nodes {
+		if node != left && node < monitor.nodeId {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var errUnknownHistoryStore = errors.New("unknown history store, expected memory or file")
+var errHistoryDisabled = errors.New("history is not kept for this channel")
+var errHistoryNotSubscribed = errors.New("history requires a subscription to the channel")
+
+// HistoryStore keeps the messages broadcast in the channels of an app, so
+// they can be replayed to clients joining later.
+type HistoryStore interface {
+	Append(channelName string, message *Message) error
+
+	// Read returns the stored messages matching the request, oldest first.
+	Read(channelName string, request *HistoryRequest) ([]*Message, error)
+
+	// LastSequence returns the sequence number of the last message appended
+	// to the channel, even once it was dropped by retention.
+	LastSequence(channelName string) (uint64, error)
+
+	Close() error
+}
+
+// newHistoryStore creates the store selected by the app's HistoryStore,
+// defaulting to memory.
+func newHistoryStore(app *App) (HistoryStore, error) {
+	maxAge := time.Duration(app.HistoryMaxAge) * time.Second
+
+	switch app.HistoryStore {
+
+	case "", "memory":
+		return newMemoryHistoryStore(app.HistorySize, maxAge), nil
+
+	case "file":
+		dir := app.HistoryDir
+		if len(dir) == 0 {
+			dir = defaultHistoryDir
+		}
+
+		// Every app logs to its own directory
+		id := app.ID
+		if len(id) == 0 {
+			id = app.Key
+		}
+
+		return newFileHistoryStore(filepath.Join(dir, escapePathName(id)), app.HistorySize, app.HistoryMaxBytes, maxAge)
+	}
+
+	return nil, errUnknownHistoryStore
+}
+
+// HistoryRequest is sent with join_channel to replay messages broadcast before
+// the join, or with a history action to fill a gap in the sequence. It selects
+// the last Limit messages of those sent at or after Since and numbered from
+// FromSequence to ToSequence.
+type HistoryRequest struct {
+	Limit        int    `json:"limit,omitempty"`
+	Since        int64  `json:"since,omitempty"`
+	FromSequence uint64 `json:"from_sequence,omitempty"`
+	ToSequence   uint64 `json:"to_sequence,omitempty"`
+}
+
+func (request *HistoryRequest) matches(message *Message) bool {
+	if message.Timestamp < request.Since || message.Sequence < request.FromSequence {
+		return false
+	}
+
+	return request.ToSequence == 0 || message.Sequence <= request.ToSequence
+}
+
+// History is a ring buffer of the last messages broadcast in a channel.
+type History struct {
+	messages []*Message
+	start    int
+	count    int
+	maxAge   time.Duration
+}
+
+func newHistory(size int, maxAge time.Duration) *History {
+	return &History{
+		messages: make([]*Message, size),
+		maxAge:   maxAge,
+	}
+}
+
+// add stores a message, overwriting the oldest one once the buffer is full.
+func (history *History) add(message *Message) {
+	size := len(history.messages)
+
+	if history.count < size {
+		history.messages[(history.start+history.count)%size] = message
+		history.count++
+		return
+	}
+
+	history.messages[history.start] = message
+	history.start = (history.start + 1) % size
+}
+
+// expire drops the messages older than the max age.
+func (history *History) expire() {
+	if history.maxAge <= 0 {
+		return
+	}
+
+	oldest := time.Now().Add(-history.maxAge).Unix()
+
+	for history.count > 0 && history.messages[history.start].Timestamp < oldest {
+		history.dropOldest()
+	}
+}
+
+// dropThrough drops the messages numbered up to sequence.
+func (history *History) dropThrough(sequence uint64) {
+	for history.count > 0 && history.messages[history.start].Sequence <= sequence {
+		history.dropOldest()
+	}
+}
+
+func (history *History) dropOldest() {
+	history.messages[history.start] = nil
+	history.start = (history.start + 1) % len(history.messages)
+	history.count--
+}
+
+// oldest returns the oldest stored message, if any.
+func (history *History) oldest() *Message {
+	if history.count == 0 {
+		return nil
+	}
+
+	return history.messages[history.start]
+}
+
+func (history *History) full() bool {
+	return history.count == len(history.messages)
+}
+
+// replay returns the stored messages matching the request, oldest first.
+func (history *History) replay(request *HistoryRequest) []*Message {
+	history.expire()
+
+	messages := make([]*Message, 0, history.count)
+
+	for i := 0; i < history.count; i++ {
+		message := history.messages[(history.start+i)%len(history.messages)]
+
+		if request.matches(message) {
+			messages = append(messages, message)
+		}
+	}
+
+	if request.Limit > 0 && len(messages) > request.Limit {
+		messages = messages[len(messages)-request.Limit:]
+	}
+
+	return messages
+}
+
+// MemoryHistoryStore keeps a History ring buffer per channel, and the last
+// sequence number of each channel. History is lost on restart.
+type MemoryHistoryStore struct {
+	size      int
+	maxAge    time.Duration
+	histories map[string]*History
+	sequences map[string]uint64
+	mu        sync.Mutex
+}
+
+func newMemoryHistoryStore(size int, maxAge time.Duration) *MemoryHistoryStore {
+	return &MemoryHistoryStore{
+		size:      size,
+		maxAge:    maxAge,
+		histories: make(map[string]*History),
+		sequences: make(map[string]uint64),
+	}
+}
+
+func (store *MemoryHistoryStore) Append(channelName string, message *Message) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	history, ok := store.histories[channelName]
+
+	if !ok {
+		history = newHistory(store.size, store.maxAge)
+		store.histories[channelName] = history
+	}
+
+	history.add(message)
+	store.sequences[channelName] = message.Sequence
+
+	return nil
+}
+
+func (store *MemoryHistoryStore) Read(channelName string, request *HistoryRequest) ([]*Message, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if history, ok := store.histories[channelName]; ok {
+		return history.replay(request), nil
+	}
+
+	return nil, nil
+}
+
+func (store *MemoryHistoryStore) LastSequence(channelName string) (uint64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.sequences[channelName], nil
+}
+
+func (store *MemoryHistoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// historyMessages numbers count messages from 1, sent at timestamp.
+func historyMessages(count int, timestamp int64) []*Message {
+	messages := make([]*Message, count)
+
+	for i := range messages {
+		messages[i] = &Message{
+			Action:    SendMessageAction,
+			Name:      "channel",
+			Event:     "event",
+			Sequence:  uint64(i + 1),
+			Timestamp: timestamp,
+		}
+	}
+
+	return messages
+}
+
+func sequences(messages []*Message) []uint64 {
+	numbers := make([]uint64, len(messages))
+
+	for i, message := range messages {
+		numbers[i] = message.Sequence
+	}
+
+	return numbers
+}
+
+func equalSequences(a []uint64, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestHistoryRequestMatches(t *testing.T) {
+	message := &Message{Sequence: 5, Timestamp: 100}
+
+	tests := []struct {
+		name    string
+		request HistoryRequest
+		matches bool
+	}{
+		{"everything", HistoryRequest{}, true},
+		{"since before", HistoryRequest{Since: 100}, true},
+		{"since after", HistoryRequest{Since: 101}, false},
+		{"from sequence", HistoryRequest{FromSequence: 5}, true},
+		{"after from sequence", HistoryRequest{FromSequence: 6}, false},
+		{"to sequence", HistoryRequest{ToSequence: 5}, true},
+		{"before to sequence", HistoryRequest{ToSequence: 4}, false},
+		{"range", HistoryRequest{FromSequence: 3, ToSequence: 7}, true},
+	}
+
+	for _, test := range tests {
+		if got := test.request.matches(message); got != test.matches {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.matches)
+		}
+	}
+}
+
+func TestMemoryHistoryStore(t *testing.T) {
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name    string
+		size    int
+		count   int
+		request HistoryRequest
+		want    []uint64
+	}{
+		{"all", 5, 3, HistoryRequest{}, []uint64{1, 2, 3}},
+		{"ring buffer keeps the last", 3, 5, HistoryRequest{}, []uint64{3, 4, 5}},
+		{"limit keeps the last", 5, 5, HistoryRequest{Limit: 2}, []uint64{4, 5}},
+		{"from sequence", 5, 5, HistoryRequest{FromSequence: 4}, []uint64{4, 5}},
+		{"sequence range", 5, 5, HistoryRequest{FromSequence: 2, ToSequence: 3}, []uint64{2, 3}},
+		{"range and limit", 5, 5, HistoryRequest{FromSequence: 2, Limit: 1}, []uint64{5}},
+		{"since", 5, 3, HistoryRequest{Since: now + 1}, []uint64{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newMemoryHistoryStore(test.size, 0)
+
+			for _, message := range historyMessages(test.count, now) {
+				if err := store.Append("channel", message); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			messages, err := store.Read("channel", &test.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := sequences(messages); !equalSequences(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMemoryHistoryStoreMaxAge(t *testing.T) {
+	store := newMemoryHistoryStore(10, time.Minute)
+
+	old := historyMessages(2, time.Now().Add(-2*time.Minute).Unix())
+	recent := historyMessages(4, time.Now().Unix())[2:]
+
+	for _, message := range append(old, recent...) {
+		store.Append("channel", message)
+	}
+
+	messages, _ := store.Read("channel", &HistoryRequest{})
+
+	if got := sequences(messages); !equalSequences(got, []uint64{3, 4}) {
+		t.Errorf("got %v, want [3 4]", got)
+	}
+}
+
+func TestMemoryHistoryStoreChannels(t *testing.T) {
+	store := newMemoryHistoryStore(10, 0)
+
+	store.Append("a", &Message{Sequence: 1})
+
+	if messages, _ := store.Read("b", &HistoryRequest{}); len(messages) != 0 {
+		t.Errorf("read %d messages of another channel", len(messages))
+	}
+}
+
+func TestMemoryHistoryStoreLastSequence(t *testing.T) {
+	store := newMemoryHistoryStore(2, time.Minute)
+
+	if sequence, _ := store.LastSequence("channel"); sequence != 0 {
+		t.Errorf("got %d for an empty channel, want 0", sequence)
+	}
+
+	// Messages dropped from the buffer or expired still count
+	appendMessages(t, store, "channel", historyMessages(5, time.Now().Add(-2*time.Minute).Unix()))
+
+	if messages, _ := store.Read("channel", &HistoryRequest{}); len(messages) != 0 {
+		t.Fatalf("got %d messages, want them expired", len(messages))
+	}
+
+	if sequence, _ := store.LastSequence("channel"); sequence != 5 {
+		t.Errorf("got %d, want 5", sequence)
+	}
+}
+
+func TestCreateChannelContinuesSequence(t *testing.T) {
+	app := &App{Key: "key", HistorySize: 10, HistoryChannels: []string{"chat-*"}}
+	store := newMemoryHistoryStore(app.HistorySize, 0)
+
+	store.Append("chat-a", &Message{Sequence: 7, Timestamp: time.Now().Unix()})
+	store.Append("other", &Message{Sequence: 3, Timestamp: time.Now().Unix()})
+
+	server := newWebsocketServer(app, newMemoryBroker(), "node", store)
+
+	if channel := server.createChannel("chat-a", false); channel.sequence != 7 {
+		t.Errorf("got sequence %d, want 7", channel.sequence)
+	}
+
+	// Channels without history start from zero
+	if channel := server.createChannel("other", false); channel.sequence != 0 {
+		t.Errorf("got sequence %d, want 0", channel.sequence)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Allowed clock skew when validating exp and nbf.
+	jwtLeeway = 30 * time.Second
+)
+
+var (
+	errTokenMalformed    = errors.New("token is malformed")
+	errTokenAlgorithm    = errors.New("token algorithm is not supported")
+	errTokenKeyNotFound  = errors.New("no key found to verify token")
+	errTokenSignature    = errors.New("token signature is invalid")
+	errTokenExpired      = errors.New("token is expired")
+	errTokenNoExpiry     = errors.New("token has no exp claim")
+	errTokenNotYetValid  = errors.New("token is not valid yet")
+	errTokenAudience     = errors.New("token audience is invalid")
+	errTokenAppAudience  = errors.New("token audience does not include the app key")
+	errTokenIssuer       = errors.New("token issuer is invalid")
+	errJWTNotConfigured  = errors.New("no JWT secret, public key or JWKS file is configured")
+	errUnsupportedJWKKey = errors.New("unsupported JWK key type")
+)
+
+// Claims are the validated claims of a connection token. Registered claims
+// are decoded into fields, every claim stays available through Get.
+type Claims struct {
+	Subject   string
+	Issuer    string
+	Audience  []string
+	ExpiresAt int64
+	NotBefore int64
+	raw       map[string]json.RawMessage
+}
+
+// Get decodes the named claim into v, reporting whether the claim was present.
+func (claims *Claims) Get(name string, v interface{}) bool {
+	value, ok := claims.raw[name]
+	if !ok {
+		return false
+	}
+
+	return json.Unmarshal(value, v) == nil
+}
+
+// JWTVerifier validates connection tokens signed with HS256, RS256 or ES256.
+// Tokens must expire unless allowNoExpiry is set.
+type JWTVerifier struct {
+	secret        []byte
+	publicKey     crypto.PublicKey
+	keys          map[string]crypto.PublicKey
+	audience      string
+	issuer        string
+	allowNoExpiry bool
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// newJWTVerifier builds a verifier from JWT_SECRET, JWT_PUBLIC_KEY (a PEM
+// file), JWT_JWKS_FILE, JWT_AUDIENCE, JWT_ISSUER and JWT_ALLOW_NO_EXPIRY.
+func newJWTVerifier() (*JWTVerifier, error) {
+	verifier := &JWTVerifier{
+		secret:   []byte(os.Getenv("JWT_SECRET")),
+		keys:     make(map[string]crypto.PublicKey),
+		audience: os.Getenv("JWT_AUDIENCE"),
+		issuer:   os.Getenv("JWT_ISSUER"),
+	}
+
+	verifier.allowNoExpiry, _ = strconv.ParseBool(os.Getenv("JWT_ALLOW_NO_EXPIRY"))
+
+	if path := os.Getenv("JWT_PUBLIC_KEY"); len(path) > 0 {
+		key, err := loadPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+
+		verifier.publicKey = key
+	}
+
+	if path := os.Getenv("JWT_JWKS_FILE"); len(path) > 0 {
+		if err := verifier.loadJWKS(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return verifier, nil
+}
+
+func (verifier *JWTVerifier) configured() bool {
+	return len(verifier.secret) > 0 || verifier.publicKey != nil || len(verifier.keys) > 0
+}
+
+// Verify checks the token signature and its exp, nbf, aud and iss claims.
+func (verifier *JWTVerifier) Verify(token string) (*Claims, error) {
+	if !verifier.configured() {
+		return nil, errJWTNotConfigured
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errTokenMalformed
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errTokenMalformed
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errTokenMalformed
+	}
+
+	if err := verifier.verifySignature(header, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	claims := &Claims{}
+	if err := decodeSegment(parts[1], &claims.raw); err != nil {
+		return nil, errTokenMalformed
+	}
+
+	claims.Get("sub", &claims.Subject)
+	claims.Get("iss", &claims.Issuer)
+	if claims.ExpiresAt, err = claims.numericDate("exp"); err != nil {
+		return nil, err
+	}
+
+	if claims.NotBefore, err = claims.numericDate("nbf"); err != nil {
+		return nil, err
+	}
+
+	if _, err = claims.numericDate("iat"); err != nil {
+		return nil, err
+	}
+
+	var audience string
+	if claims.Get("aud", &audience) {
+		claims.Audience = []string{audience}
+	} else {
+		claims.Get("aud", &claims.Audience)
+	}
+
+	if err := verifier.validateClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// numericDate decodes a NumericDate claim, which may have a fractional part,
+// into seconds since the epoch. A missing claim is 0, a non numeric one is
+// malformed.
+func (claims *Claims) numericDate(name string) (int64, error) {
+	value, ok := claims.raw[name]
+	if !ok {
+		return 0, nil
+	}
+
+	var seconds float64
+	if err := json.Unmarshal(value, &seconds); err != nil {
+		return 0, errTokenMalformed
+	}
+
+	return int64(seconds), nil
+}
+
+// hasAudience reports whether the token was issued for the audience.
+func (claims *Claims) hasAudience(audience string) bool {
+	for _, value := range claims.Audience {
+		if value == audience {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (verifier *JWTVerifier) verifySignature(header jwtHeader, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+
+	switch header.Alg {
+
+	case "HS256":
+		if len(verifier.secret) == 0 {
+			return errTokenKeyNotFound
+		}
+
+		mac := hmac.New(sha256.New, verifier.secret)
+		mac.Write([]byte(signed))
+
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return errTokenSignature
+		}
+
+	case "RS256":
+		key, ok := verifier.findKey(header.Kid).(*rsa.PublicKey)
+		if !ok {
+			return errTokenKeyNotFound
+		}
+
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return errTokenSignature
+		}
+
+	case "ES256":
+		key, ok := verifier.findKey(header.Kid).(*ecdsa.PublicKey)
+		if !ok || key.Curve != elliptic.P256() {
+			return errTokenKeyNotFound
+		}
+
+		if len(signature) != 64 {
+			return errTokenSignature
+		}
+
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return errTokenSignature
+		}
+
+	default:
+		return errTokenAlgorithm
+	}
+
+	return nil
+}
+
+// findKey returns the JWKS key matching kid, falling back to the PEM key.
+func (verifier *JWTVerifier) findKey(kid string) crypto.PublicKey {
+	if key, ok := verifier.keys[kid]; ok {
+		return key
+	}
+
+	if verifier.publicKey != nil {
+		return verifier.publicKey
+	}
+
+	// A JWKS with a single key doesn't need a kid in the token
+	if len(kid) == 0 && len(verifier.keys) == 1 {
+		for _, key := range verifier.keys {
+			return key
+		}
+	}
+
+	return nil
+}
+
+func (verifier *JWTVerifier) validateClaims(claims *Claims) error {
+	now := time.Now()
+
+	if claims.ExpiresAt == 0 && !verifier.allowNoExpiry {
+		return errTokenNoExpiry
+	}
+
+	if claims.ExpiresAt != 0 && now.After(time.Unix(claims.ExpiresAt, 0).Add(jwtLeeway)) {
+		return errTokenExpired
+	}
+
+	if claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0).Add(-jwtLeeway)) {
+		return errTokenNotYetValid
+	}
+
+	if len(verifier.audience) > 0 && !claims.hasAudience(verifier.audience) {
+		return errTokenAudience
+	}
+
+	if len(verifier.issuer) > 0 && claims.Issuer != verifier.issuer {
+		return errTokenIssuer
+	}
+
+	return nil
+}
+
+func (verifier *JWTVerifier) loadJWKS(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return err
+	}
+
+	for _, jwk := range jwks.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			return err
+		}
+
+		verifier.keys[jwk.Kid] = key
+	}
+
+	return nil
+}
+
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, errUnsupportedJWKKey
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+
+	return nil, errUnsupportedJWKKey
+}
+
+// loadPublicKey reads an RSA or EC public key, or a certificate, from a PEM file.
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found in " + path)
+	}
+
+	switch block.Type {
+
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		return cert.PublicKey, nil
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
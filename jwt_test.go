@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("secret")
+
+// signToken builds a token with the header and claims, signed with key: a
+// secret for HS256, an RSA or EC private key for RS256 and ES256.
+func signToken(t *testing.T, header map[string]interface{}, claims map[string]interface{}, key interface{}) string {
+	t.Helper()
+
+	segment := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	signed := segment(header) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+
+	switch key := key.(type) {
+
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func hsToken(t *testing.T, claims map[string]interface{}) string {
+	return signToken(t, map[string]interface{}{"alg": "HS256", "typ": "JWT"}, claims, testSecret)
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub": "user",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestJWTVerifierClaims(t *testing.T) {
+	now := time.Now()
+
+	with := func(changes map[string]interface{}) map[string]interface{} {
+		claims := validClaims()
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+
+		return claims
+	}
+
+	tests := []struct {
+		name     string
+		verifier *JWTVerifier
+		claims   map[string]interface{}
+		err      error
+	}{
+		{"valid", &JWTVerifier{secret: testSecret}, validClaims(), nil},
+		{"expired", &JWTVerifier{secret: testSecret}, with(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}), errTokenExpired},
+		{"expired within leeway", &JWTVerifier{secret: testSecret}, with(map[string]interface{}{"exp": now.Add(-jwtLeeway / 2).Unix()}), nil},
+		{"missing exp", &JWTVerifier{secret: testSecret}, with(map[string]interface{}{"exp": nil}), errTokenNoExpiry},
+		{"missing exp allowed", &JWTVerifier{secret: testSecret, allowNoExpiry: true}, with(map[string]interface{}{"exp": nil}), nil},
+		{"not yet valid", &JWTVerifier{secret: testSecret}, with(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()}), errTokenNotYetValid},
+		{"nbf within leeway", &JWTVerifier{secret: testSecret}, with(map[string]interface{}{"nbf": now.Add(jwtLeeway / 2).Unix()}), nil},
+		{"fractional exp", &JWTVerifier{secret: testSecret}, with(map[string]interface{}{"exp": float64(now.Add(time.Hour).Unix()) + 0.5}), nil},
+		{"fractional exp expired", &JWTVerifier{secret: testSecret}, with(map[string]interface{}{"exp": float64(now.Add(-time.Hour).Unix()) + 0.5}), errTokenExpired},
+		{"malformed exp", &JWTVerifier{secret: testSecret}, with(map[string]interface{}{"exp": "tomorrow"}), errTokenMalformed},
+		{"malformed exp allowed", &JWTVerifier{secret: testSecret, allowNoExpiry: true}, with(map[string]interface{}{"exp": "tomorrow"}), errTokenMalformed},
+		{"malformed nbf", &JWTVerifier{secret: testSecret}, with(map[string]interface{}{"nbf": true}), errTokenMalformed},
+		{"malformed iat", &JWTVerifier{secret: testSecret}, with(map[string]interface{}{"iat": "now"}), errTokenMalformed},
+		{"nbf passed", &JWTVerifier{secret: testSecret}, with(map[string]interface{}{"nbf": now.Add(-time.Hour).Unix()}), nil},
+		{"audience", &JWTVerifier{secret: testSecret, audience: "app"}, with(map[string]interface{}{"aud": "app"}), nil},
+		{"audience list", &JWTVerifier{secret: testSecret, audience: "app"}, with(map[string]interface{}{"aud": []string{"other", "app"}}), nil},
+		{"wrong audience", &JWTVerifier{secret: testSecret, audience: "app"}, with(map[string]interface{}{"aud": "other"}), errTokenAudience},
+		{"missing audience", &JWTVerifier{secret: testSecret, audience: "app"}, validClaims(), errTokenAudience},
+		{"issuer", &JWTVerifier{secret: testSecret, issuer: "iss"}, with(map[string]interface{}{"iss": "iss"}), nil},
+		{"wrong issuer", &JWTVerifier{secret: testSecret, issuer: "iss"}, with(map[string]interface{}{"iss": "other"}), errTokenIssuer},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := test.verifier.Verify(hsToken(t, test.claims))
+
+			if err != test.err {
+				t.Fatalf("got %v, want %v", err, test.err)
+			}
+
+			if err == nil && claims.Subject != "user" {
+				t.Errorf("got subject %q, want user", claims.Subject)
+			}
+		})
+	}
+}
+
+func TestJWTVerifierSignature(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherEcKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs := map[string]interface{}{"alg": "HS256"}
+	rs := map[string]interface{}{"alg": "RS256"}
+	es := map[string]interface{}{"alg": "ES256", "kid": "ec"}
+
+	keys := &JWTVerifier{
+		publicKey: &rsaKey.PublicKey,
+		keys:      map[string]crypto.PublicKey{"ec": &ecKey.PublicKey},
+	}
+
+	valid := hsToken(t, validClaims())
+	parts := strings.Split(valid, ".")
+
+	tampered := []byte(parts[2])
+	if tampered[0] == 'A' {
+		tampered[0] = 'B'
+	} else {
+		tampered[0] = 'A'
+	}
+
+	otherClaims := validClaims()
+	otherClaims["sub"] = "admin"
+	otherPayload := strings.Split(hsToken(t, otherClaims), ".")[1]
+
+	tests := []struct {
+		name     string
+		verifier *JWTVerifier
+		token    string
+		err      error
+	}{
+		{"HS256", &JWTVerifier{secret: testSecret}, valid, nil},
+		{"RS256", keys, signToken(t, rs, validClaims(), rsaKey), nil},
+		{"ES256 by kid", keys, signToken(t, es, validClaims(), ecKey), nil},
+		{"wrong secret", &JWTVerifier{secret: []byte("other")}, valid, errTokenSignature},
+		{"tampered signature", &JWTVerifier{secret: testSecret}, parts[0] + "." + parts[1] + "." + string(tampered), errTokenSignature},
+		{"tampered claims", &JWTVerifier{secret: testSecret}, parts[0] + "." + otherPayload + "." + parts[2], errTokenSignature},
+		{"wrong EC key", keys, signToken(t, es, validClaims(), otherEcKey), errTokenSignature},
+		{"alg none", &JWTVerifier{secret: testSecret}, signToken(t, map[string]interface{}{"alg": "none"}, validClaims(), nil), errTokenAlgorithm},
+		{"alg HS512", &JWTVerifier{secret: testSecret}, signToken(t, map[string]interface{}{"alg": "HS512"}, validClaims(), testSecret), errTokenAlgorithm},
+		{"HS256 without a secret", keys, signToken(t, hs, validClaims(), testSecret), errTokenKeyNotFound},
+		{"RS256 without a key", &JWTVerifier{secret: testSecret}, signToken(t, rs, validClaims(), rsaKey), errTokenKeyNotFound},
+		{"two segments", &JWTVerifier{secret: testSecret}, parts[0] + "." + parts[1], errTokenMalformed},
+		{"bad header", &JWTVerifier{secret: testSecret}, "!." + parts[1] + "." + parts[2], errTokenMalformed},
+		{"not configured", &JWTVerifier{}, valid, errJWTNotConfigured},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.verifier.Verify(test.token); err != test.err {
+				t.Errorf("got %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestClaimsGet(t *testing.T) {
+	claims := validClaims()
+	claims["direct_messages"] = true
+
+	verified, err := (&JWTVerifier{secret: testSecret}).Verify(hsToken(t, claims))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var allowed bool
+	if !verified.Get("direct_messages", &allowed) || !allowed {
+		t.Errorf("direct_messages claim not decoded")
+	}
+
+	var missing string
+	if verified.Get("missing", &missing) {
+		t.Errorf("missing claim reported as present")
+	}
+}
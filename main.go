@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 )
 
@@ -32,15 +33,80 @@ func main() {
 
 	port := os.Getenv("PORT")
 
-	server := newWebsocketServer()
+	verifier, err := newJWTVerifier()
 
-	go server.Run()
+	if err != nil {
+		log.Fatal("Error loading JWT keys: ", err)
+	}
+
+	apps, err := loadApps()
+
+	if err != nil {
+		log.Fatal("Error loading apps: ", err)
+	}
+
+	nodeId := os.Getenv("NODE_ID")
+
+	if len(nodeId) == 0 {
+		nodeId = uuid.New().String()
+	}
+
+	broker, err := newBroker(nodeId)
+
+	if err != nil {
+		log.Fatal("Error creating broker: ", err)
+	}
+
+	appsByKey := make(map[string]*App)
+
+	for _, app := range apps {
+		history, err := newHistoryStore(app)
+
+		if err != nil {
+			log.Fatal("Error creating history store: ", err)
+		}
+
+		app.server = newWebsocketServer(app, broker, nodeId, history)
+		go app.server.Run()
+
+		appsByKey[app.Key] = app
+	}
+
+	monitor := newNodeMonitor(broker, nodeId)
+
+	// Resync presence with nodes that join and drop the users of nodes that leave
+	monitor.OnNodeJoined(func(node string) {
+		for _, app := range apps {
+			app.server.notifyChannels(&BrokerEnvelope{Kind: BrokerNodeJoined, Node: node})
+		}
+	})
+
+	monitor.OnNodeLeft(func(node string, leader bool) {
+		for _, app := range apps {
+			app.server.notifyChannels(&BrokerEnvelope{Kind: BrokerNodeLeft, Node: node, leader: leader})
+		}
+	})
+
+	go monitor.Run()
 
 	http.HandleFunc("/", serveHome)
 
-	http.HandleFunc("/ws", middleware(func(w http.ResponseWriter, r *http.Request) {
-		serveWs(server, w, r)
-	}))
+	http.HandleFunc("/apps/", func(w http.ResponseWriter, r *http.Request) {
+		serveApps(verifier, appsByKey, w, r)
+	})
+
+	// The unprefixed endpoints serve the app when only one is configured
+	if len(apps) == 1 {
+		defaultApp := apps[0]
+
+		for _, endpoint := range appEndpoints {
+			endpoint := endpoint
+
+			http.HandleFunc("/"+endpoint, func(w http.ResponseWriter, r *http.Request) {
+				serveApp(verifier, defaultApp, nil, endpoint, w, r)
+			})
+		}
+	}
 
 	if err := http.ListenAndServe(":"+port, nil); err != nil {
 		log.Fatal("ListenAndServe: ", err)
@@ -2,7 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
+	"strings"
+	"time"
 )
 
 const SendMessageAction = "send_message"
@@ -13,15 +16,65 @@ const MemberRemovedAction = "member_removed"
 const JoinChannelPrivateAction = "join_channel_private"
 const ChannelJoinedAction = "channel_joined"
 const ChannelUnexpectedError = "channel_unexpected_error"
+const ErrorAction = "error"
+const HistoryAction = "history"
+
+// Events published by sockets must start with ClientEventPrefix.
+const ClientEventPrefix = "client-"
+
+const ErrorCodeBadRequest = 4000
+const ErrorCodeUnauthorized = 4001
+const ErrorCodeForbidden = 4003
+
+// Maximum size of the data of a message, in bytes of raw JSON, when the app
+// doesn't set a smaller MaxDataSize. It leaves room in a frame for the other
+// fields of the message.
+const defaultMaxDataSize = 8192
 
 type Message struct {
-	Action    string   `json:"action"`
-	Event     string   `json:"event"`
-	Name      string   `json:"name"`
-	Data      string   `json:"data"`
-	Target    *Channel `json:"target"`
-	Sender    *Client  `json:"sender"`
-	Timestamp int64    `json:"timestamp"`
+	Action      string          `json:"action"`
+	Event       string          `json:"event"`
+	Name        string          `json:"name"`
+	Data        json.RawMessage `json:"data,omitempty"`
+	Target      *Channel        `json:"target"`
+	Sender      *Client         `json:"sender"`
+	Timestamp   int64           `json:"timestamp"`
+	Auth        string          `json:"auth,omitempty"`
+	ChannelData string          `json:"channel_data,omitempty"`
+	UserID      string          `json:"user_id,omitempty"`
+	// ID is unique to the message on every node. Sequence numbers the
+	// messages broadcast in a channel, as delivered by this node.
+	ID       string `json:"id,omitempty"`
+	Sequence uint64 `json:"sequence,omitempty"`
+	// Receipt asks for a delivery_receipt when a client acks the message, or a
+	// delivery_failed when the client is given up on.
+	Receipt bool `json:"receipt,omitempty"`
+	// CorrelationID pairs a reply with its request, ReplyTo is the socket id
+	// the reply goes to.
+	CorrelationID string `json:"correlation_id,omitempty"`
+	ReplyTo       string `json:"reply_to,omitempty"`
+	// SocketID is the socket a send_to_socket message is for.
+	SocketID string `json:"socket_id,omitempty"`
+	// History asks for messages sent before a join_channel.
+	History *HistoryRequest `json:"history,omitempty"`
+	// exclude is the socket id that should not receive the message.
+	exclude string
+	// receiptTo is where delivery receipts go: a socket id or ReceiptWebhook.
+	receiptTo string
+}
+
+var (
+	errNotClientEvent           = errors.New("sockets may only publish events prefixed with client-")
+	errClientEventNotSubscribed = errors.New("client events require a subscription to the channel")
+	errClientEventNotPrivate    = errors.New("client events are only allowed on private and presence channels")
+	errClientEventsDisabled     = errors.New("client events are disabled for this channel")
+	errDataTooLarge             = errors.New("message data is too large")
+)
+
+// ErrorData is the payload carried in the data of an error message.
+type ErrorData struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
 }
 
 func (message *Message) encode() []byte {
@@ -32,3 +85,23 @@ func (message *Message) encode() []byte {
 
 	return json
 }
+
+func isClientEvent(event string) bool {
+	return strings.HasPrefix(event, ClientEventPrefix)
+}
+
+// newErrorMessage builds an error message for the named channel.
+func newErrorMessage(name string, code int, text string) *Message {
+	data, err := json.Marshal(ErrorData{Code: code, Message: text})
+	if err != nil {
+		log.Println(err)
+	}
+
+	return &Message{
+		Action:    ErrorAction,
+		Event:     ErrorAction,
+		Name:      name,
+		Data:      data,
+		Timestamp: time.Now().Unix(),
+	}
+}
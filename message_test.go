@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMessageKeepsRawData(t *testing.T) {
+	tests := []string{
+		`{"text":"hi","tags":["a","b"],"count":3}`,
+		`[1,2.5,null]`,
+		`"a string"`,
+		`42`,
+		`true`,
+	}
+
+	for _, data := range tests {
+		encoded := (&Message{Action: SendMessageAction, Data: json.RawMessage(data)}).encode()
+
+		if !strings.Contains(string(encoded), `"data":`+data) {
+			t.Errorf("got %s, want the data embedded as JSON", encoded)
+		}
+
+		var message Message
+		if err := json.Unmarshal(encoded, &message); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(message.Data) != data {
+			t.Errorf("got data %s, want %s", message.Data, data)
+		}
+	}
+
+	// Messages without data leave it out
+	if encoded := (&Message{Action: SendMessageAction}).encode(); strings.Contains(string(encoded), `"data"`) {
+		t.Errorf("got %s, want no data", encoded)
+	}
+}
+
+func TestMessageHidesSenderUserID(t *testing.T) {
+	sender := &Client{ID: uuid.New(), UserID: "user"}
+	encoded := (&Message{Action: SendMessageAction, Sender: sender}).encode()
+
+	if !strings.Contains(string(encoded), sender.GetId()) {
+		t.Errorf("got %s, want the sender id", encoded)
+	}
+
+	if strings.Contains(string(encoded), "user") {
+		t.Errorf("got %s, want no user id", encoded)
+	}
+}
+
+func TestAppMaxDataSize(t *testing.T) {
+	tests := []struct {
+		configured int
+		want       int
+	}{
+		{0, defaultMaxDataSize},
+		{1024, 1024},
+		{defaultMaxDataSize * 2, defaultMaxDataSize},
+	}
+
+	for _, test := range tests {
+		if got := (&App{MaxDataSize: test.configured}).maxDataSize(); got != test.want {
+			t.Errorf("MaxDataSize %d: got %d, want %d", test.configured, got, test.want)
+		}
+	}
+}
@@ -1,28 +1,73 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"log"
 	"net/http"
-	"os"
+	"strings"
 )
 
-func middleware(f http.HandlerFunc) http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token, tok := r.URL.Query()["bearer"]
-		authToken := os.Getenv("AUTH_TOKEN")
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
 
-		if len(authToken) == 0 {
-			log.Println("An authentication token is required to use this application.")
+// middleware authenticates websocket upgrades with a signed JWT, passed in the
+// token query parameter or an Authorization bearer header. When app is set the
+// token's aud must include the app key, so a token issued for one app can't
+// connect to another. The validated claims are stored in the request context.
+func middleware(verifier *JWTVerifier, app *App, f http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !verifier.configured() {
+			log.Println("A JWT secret, public key or JWKS file is required to use this application.")
 			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
 
-		if !tok || len(token[0]) < 1 {
+		token := r.URL.Query().Get("token")
+
+		if len(token) == 0 {
+			token = bearerToken(r)
+		}
+
+		if len(token) == 0 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := verifier.Verify(token)
+
+		if err != nil {
+			log.Printf("Rejected connection token: %s", err)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		if token[0] != authToken {
+		if app != nil && !claims.hasAudience(app.Key) {
+			log.Printf("Rejected connection token for app %s: %s", app.ID, errTokenAppAudience)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		f(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims)))
+	})
+}
+
+// apiMiddleware authenticates backend requests for an app using an
+// Authorization bearer header carrying the app's server key.
+func apiMiddleware(app *App, f http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverKey := app.ServerKey
+
+		if len(serverKey) == 0 {
+			log.Println("A server key is required to use the HTTP API.")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		token := bearerToken(r)
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(serverKey)) != 1 {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
@@ -30,3 +75,7 @@ func middleware(f http.HandlerFunc) http.HandlerFunc {
 		f(w, r)
 	})
 }
+
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareAppAudience(t *testing.T) {
+	verifier := &JWTVerifier{secret: testSecret}
+	app := &App{ID: "chat", Key: "chat-key"}
+
+	token := func(audience interface{}) string {
+		claims := map[string]interface{}{"sub": "user", "exp": time.Now().Add(time.Hour).Unix()}
+		if audience != nil {
+			claims["aud"] = audience
+		}
+
+		return hsToken(t, claims)
+	}
+
+	tests := []struct {
+		name   string
+		app    *App
+		token  string
+		status int
+	}{
+		{"app audience", app, token("chat-key"), http.StatusOK},
+		{"app in audience list", app, token([]string{"gosocks", "chat-key"}), http.StatusOK},
+		{"other app", app, token("dashboard-key"), http.StatusUnauthorized},
+		{"no audience", app, token(nil), http.StatusUnauthorized},
+		{"single app endpoint", nil, token(nil), http.StatusOK},
+		{"no token", app, "", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := middleware(verifier, test.app, func(w http.ResponseWriter, r *http.Request) {
+				if _, ok := r.Context().Value(claimsContextKey).(*Claims); !ok {
+					t.Errorf("claims missing from the request context")
+				}
+			})
+
+			recorder := httptest.NewRecorder()
+			handler(recorder, httptest.NewRequest(http.MethodGet, "/apps/chat-key/ws?token="+test.token, nil))
+
+			if recorder.Code != test.status {
+				t.Errorf("got status %d, want %d", recorder.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestServeAppsRoutes(t *testing.T) {
+	verifier := &JWTVerifier{secret: testSecret}
+
+	app := &App{ID: "chat", Key: "chat-key", ServerKey: "server-key"}
+	app.server = newWebsocketServer(app, newMemoryBroker(), "node", nil)
+	go app.server.Run()
+
+	apps := map[string]*App{app.Key: app}
+	token := hsToken(t, map[string]interface{}{"sub": "user", "exp": time.Now().Add(time.Hour).Unix()})
+
+	tests := []struct {
+		name      string
+		path      string
+		serverKey string
+		status    int
+	}{
+		{"unknown app", "/apps/other-key/events", "server-key", http.StatusNotFound},
+		{"no app key", "/apps//events", "server-key", http.StatusNotFound},
+		{"unknown endpoint", "/apps/chat-key/other", "server-key", http.StatusNotFound},
+		{"no endpoint", "/apps/chat-key", "server-key", http.StatusNotFound},
+		{"api without server key", "/apps/chat-key/events", "", http.StatusUnauthorized},
+		{"api with server key", "/apps/chat-key/events", "server-key", http.StatusMethodNotAllowed},
+		{"ws token without app audience", "/apps/chat-key/ws?token=" + token, "", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if len(test.serverKey) > 0 {
+				request.Header.Set("Authorization", "Bearer "+test.serverKey)
+			}
+
+			recorder := httptest.NewRecorder()
+			serveApps(verifier, apps, recorder, request)
+
+			if recorder.Code != test.status {
+				t.Errorf("got status %d, want %d", recorder.Code, test.status)
+			}
+		})
+	}
+
+	// The default app's endpoints don't ask for the app key in aud, the
+	// websocket upgrade fails as the request isn't one
+	recorder := httptest.NewRecorder()
+	serveApp(verifier, app, nil, "ws", recorder, httptest.NewRequest(http.MethodGet, "/ws?token="+token, nil))
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// MsgpackSubprotocol selects binary MessagePack frames.
+const MsgpackSubprotocol = "gosocks.msgpack"
+
+var errMsgpackMalformed = errors.New("malformed msgpack frame")
+var errMsgpackUnsupported = errors.New("msgpack frame uses a type without a JSON equivalent")
+
+// MsgpackCodec writes messages as binary MessagePack frames. A frame holds
+// the same map of fields as the JSON encoding of the message, so both read
+// the same on the client.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (MsgpackCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func (MsgpackCodec) Encode(message []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	decoder.UseNumber()
+
+	var value interface{}
+
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	return appendMsgpack(make([]byte, 0, len(message)), value)
+}
+
+func (MsgpackCodec) Decode(frame []byte) ([]byte, error) {
+	reader := &msgpackReader{data: frame}
+
+	value, err := reader.read()
+	if err != nil {
+		return nil, err
+	}
+
+	if reader.pos != len(frame) {
+		return nil, errMsgpackMalformed
+	}
+
+	return json.Marshal(value)
+}
+
+// appendMsgpack appends the MessagePack encoding of a value decoded from
+// JSON. Map keys are sorted so the encoding is stable.
+func appendMsgpack(b []byte, value interface{}) ([]byte, error) {
+	switch value := value.(type) {
+
+	case nil:
+		return append(b, 0xc0), nil
+
+	case bool:
+		if value {
+			return append(b, 0xc3), nil
+		}
+
+		return append(b, 0xc2), nil
+
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return appendMsgpackInt(b, i), nil
+		}
+
+		if u, err := strconv.ParseUint(string(value), 10, 64); err == nil {
+			return binary.BigEndian.AppendUint64(append(b, 0xcf), u), nil
+		}
+
+		f, err := value.Float64()
+		if err != nil {
+			return nil, err
+		}
+
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(f)), nil
+
+	case string:
+		return append(appendMsgpackHeader(b, len(value), 0xa0, 32, 0xd9, 0xda, 0xdb), value...), nil
+
+	case []interface{}:
+		b = appendMsgpackHeader(b, len(value), 0x90, 16, 0, 0xdc, 0xdd)
+
+		for _, item := range value {
+			var err error
+			if b, err = appendMsgpack(b, item); err != nil {
+				return nil, err
+			}
+		}
+
+		return b, nil
+
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		b = appendMsgpackHeader(b, len(value), 0x80, 16, 0, 0xde, 0xdf)
+
+		for _, key := range keys {
+			var err error
+			if b, err = appendMsgpack(b, key); err != nil {
+				return nil, err
+			}
+
+			if b, err = appendMsgpack(b, value[key]); err != nil {
+				return nil, err
+			}
+		}
+
+		return b, nil
+	}
+
+	return nil, errMsgpackUnsupported
+}
+
+func appendMsgpackInt(b []byte, i int64) []byte {
+	switch {
+
+	case i >= 0 && i < 128:
+		return append(b, byte(i))
+
+	case i >= -32 && i < 0:
+		return append(b, byte(int8(i)))
+
+	case i >= 0 && i <= math.MaxUint8:
+		return append(b, 0xcc, byte(i))
+
+	case i >= 0 && i <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(i))
+
+	case i >= 0 && i <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(i))
+
+	case i >= 0:
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), uint64(i))
+
+	case i >= math.MinInt8:
+		return append(b, 0xd0, byte(int8(i)))
+
+	case i >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(int16(i)))
+
+	case i >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(int32(i)))
+	}
+
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(i))
+}
+
+// appendMsgpackHeader appends the type and length of a string, array or map,
+// using the fix format below fixLimit and the 8, 16 or 32 bit format above.
+// Arrays and maps have no 8 bit format.
+func appendMsgpackHeader(b []byte, n int, fix byte, fixLimit int, format8 byte, format16 byte, format32 byte) []byte {
+	switch {
+
+	case n < fixLimit:
+		return append(b, fix|byte(n))
+
+	case format8 != 0 && n <= math.MaxUint8:
+		return append(b, format8, byte(n))
+
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, format16), uint16(n))
+	}
+
+	return binary.BigEndian.AppendUint32(append(b, format32), uint32(n))
+}
+
+// msgpackReader decodes a MessagePack frame into the values JSON decodes to.
+type msgpackReader struct {
+	data []byte
+	pos  int
+}
+
+func (reader *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || len(reader.data)-reader.pos < n {
+		return nil, errMsgpackMalformed
+	}
+
+	b := reader.data[reader.pos : reader.pos+n]
+	reader.pos += n
+
+	return b, nil
+}
+
+// length reads a big endian length of size bytes.
+func (reader *msgpackReader) length(size int) (int, error) {
+	b, err := reader.next(size)
+	if err != nil {
+		return 0, err
+	}
+
+	switch size {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	}
+
+	return int(binary.BigEndian.Uint32(b)), nil
+}
+
+func (reader *msgpackReader) read() (interface{}, error) {
+	b, err := reader.next(1)
+	if err != nil {
+		return nil, err
+	}
+
+	format := b[0]
+
+	switch {
+
+	case format <= 0x7f:
+		return int64(format), nil
+
+	case format >= 0xe0:
+		return int64(int8(format)), nil
+
+	case format >= 0x80 && format <= 0x8f:
+		return reader.readMap(int(format & 0x0f))
+
+	case format >= 0x90 && format <= 0x9f:
+		return reader.readArray(int(format & 0x0f))
+
+	case format >= 0xa0 && format <= 0xbf:
+		return reader.readString(int(format & 0x1f))
+	}
+
+	switch format {
+
+	case 0xc0:
+		return nil, nil
+
+	case 0xc2:
+		return false, nil
+
+	case 0xc3:
+		return true, nil
+
+	case 0xc4, 0xd9:
+		return reader.readSized(1, reader.readString)
+
+	case 0xc5, 0xda:
+		return reader.readSized(2, reader.readString)
+
+	case 0xc6, 0xdb:
+		return reader.readSized(4, reader.readString)
+
+	case 0xca:
+		b, err := reader.next(4)
+		if err != nil {
+			return nil, err
+		}
+
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+
+	case 0xcb:
+		b, err := reader.next(8)
+		if err != nil {
+			return nil, err
+		}
+
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		b, err := reader.next(1 << (format - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+
+		return u, nil
+
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (format - 0xd0)
+
+		b, err := reader.next(size)
+		if err != nil {
+			return nil, err
+		}
+
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+
+		// Sign extend from the size read
+		shift := 64 - 8*size
+		return int64(u<<shift) >> shift, nil
+
+	case 0xdc:
+		return reader.readSized(2, reader.readArray)
+
+	case 0xdd:
+		return reader.readSized(4, reader.readArray)
+
+	case 0xde:
+		return reader.readSized(2, reader.readMap)
+
+	case 0xdf:
+		return reader.readSized(4, reader.readMap)
+	}
+
+	return nil, errMsgpackUnsupported
+}
+
+// readSized reads a length of size bytes and then what it is the length of.
+func (reader *msgpackReader) readSized(size int, read func(n int) (interface{}, error)) (interface{}, error) {
+	n, err := reader.length(size)
+	if err != nil {
+		return nil, err
+	}
+
+	return read(n)
+}
+
+func (reader *msgpackReader) readString(n int) (interface{}, error) {
+	b, err := reader.next(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+func (reader *msgpackReader) readArray(n int) (interface{}, error) {
+	// Every item takes at least a byte
+	if n > len(reader.data)-reader.pos {
+		return nil, errMsgpackMalformed
+	}
+
+	array := make([]interface{}, 0, n)
+
+	for i := 0; i < n; i++ {
+		item, err := reader.read()
+		if err != nil {
+			return nil, err
+		}
+
+		array = append(array, item)
+	}
+
+	return array, nil
+}
+
+func (reader *msgpackReader) readMap(n int) (interface{}, error) {
+	if n > len(reader.data)-reader.pos {
+		return nil, errMsgpackMalformed
+	}
+
+	object := make(map[string]interface{}, n)
+
+	for i := 0; i < n; i++ {
+		key, err := reader.read()
+		if err != nil {
+			return nil, err
+		}
+
+		name, ok := key.(string)
+		if !ok {
+			return nil, errMsgpackUnsupported
+		}
+
+		if object[name], err = reader.read(); err != nil {
+			return nil, err
+		}
+	}
+
+	return object, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// fullMessage sets every field of a Message that is sent to clients.
+func fullMessage() *Message {
+	return &Message{
+		Action:        SendMessageAction,
+		Event:         "client-event",
+		Name:          "private-chat",
+		Data:          json.RawMessage(`{"list":[1,-2,3.5,true,null],"text":"héllo"}`),
+		Target:        &Channel{ID: uuid.New(), Name: "private-chat", Private: true},
+		Sender:        &Client{ID: uuid.New(), UserID: "user"},
+		Timestamp:     1700000000,
+		Auth:          "key:signature",
+		ChannelData:   `{"user_id":"user"}`,
+		UserID:        "user",
+		ID:            uuid.New().String(),
+		Sequence:      42,
+		Receipt:       true,
+		CorrelationID: "correlation",
+		ReplyTo:       "socket",
+		SocketID:      "other-socket",
+		History:       &HistoryRequest{Limit: 10, Since: 1600000000, FromSequence: 3, ToSequence: 9},
+	}
+}
+
+// roundTrip encodes the JSON of a message with the codec, decodes the frame
+// back to JSON and returns both messages, as read from JSON.
+func roundTrip(t *testing.T, codec Codec, message *Message) (*Message, *Message) {
+	t.Helper()
+
+	encoded := message.encode()
+
+	frame, err := codec.Encode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := codec.Decode(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want, got Message
+
+	if err := json.Unmarshal(encoded, &want); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal(decoded, &got); err != nil {
+		t.Fatalf("decoded invalid JSON %s: %s", decoded, err)
+	}
+
+	return &want, &got
+}
+
+func TestMsgpackRoundTripsMessage(t *testing.T) {
+	want, got := roundTrip(t, MsgpackCodec{}, fullMessage())
+
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// The data keeps its JSON, with keys sorted
+	if string(got.Data) != string(want.Data) {
+		t.Errorf("got data %s, want %s", got.Data, want.Data)
+	}
+}
+
+func TestMsgpackRoundTripsValues(t *testing.T) {
+	tests := []string{
+		`null`,
+		`true`,
+		`false`,
+		`0`,
+		`127`,
+		`128`,
+		`255`,
+		`65535`,
+		`65536`,
+		`4294967296`,
+		`18446744073709551615`,
+		`-1`,
+		`-32`,
+		`-33`,
+		`-129`,
+		`-32769`,
+		`-2147483649`,
+		`1.5`,
+		`-0.25`,
+		`""`,
+		`"` + strings.Repeat("a", 31) + `"`,
+		`"` + strings.Repeat("a", 255) + `"`,
+		`"` + strings.Repeat("a", 65536) + `"`,
+		`[]`,
+		`[` + strings.TrimSuffix(strings.Repeat("1,", 16), ",") + `]`,
+		`{}`,
+		`{"a":{"b":[{"c":"d"}]}}`,
+	}
+
+	for _, test := range tests {
+		frame, err := MsgpackCodec{}.Encode([]byte(test))
+		if err != nil {
+			t.Errorf("%.40s: %s", test, err)
+			continue
+		}
+
+		decoded, err := MsgpackCodec{}.Decode(frame)
+		if err != nil {
+			t.Errorf("%.40s: %s", test, err)
+			continue
+		}
+
+		if string(decoded) != test {
+			t.Errorf("got %.40s, want %.40s", decoded, test)
+		}
+	}
+
+	// Maps with 16 keys or more use the map 16 format
+	wide := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		wide[strings.Repeat("k", i+1)] = i
+	}
+
+	encoded, _ := json.Marshal(wide)
+	frame, _ := MsgpackCodec{}.Encode(encoded)
+
+	if frame[0] != 0xde {
+		t.Errorf("got format %#x, want map 16", frame[0])
+	}
+
+	if decoded, err := (MsgpackCodec{}).Decode(frame); err != nil || string(decoded) != string(encoded) {
+		t.Errorf("got %s, %v, want %s", decoded, err, encoded)
+	}
+}
+
+func TestMsgpackEncoding(t *testing.T) {
+	frame, err := MsgpackCodec{}.Encode([]byte(`{"b":[1,-1],"a":"x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fixmap of 2, sorted keys, fixstr and fixarray values
+	want := []byte{0x82, 0xa1, 'a', 0xa1, 'x', 0xa1, 'b', 0x92, 0x01, 0xff}
+
+	if !bytes.Equal(frame, want) {
+		t.Errorf("got % x, want % x", frame, want)
+	}
+}
+
+func TestMsgpackDecodeRejects(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":          {},
+		"truncated":      {0x82, 0xa1, 'a'},
+		"trailing bytes": {0xc0, 0xc0},
+		"array too long": {0xdd, 0xff, 0xff, 0xff, 0xff},
+		"integer key":    {0x81, 0x01, 0x01},
+		"extension":      {0xd4, 0x01, 0x01},
+	}
+
+	for name, frame := range tests {
+		if _, err := (MsgpackCodec{}).Decode(frame); err == nil {
+			t.Errorf("%s: decoded % x", name, frame)
+		}
+	}
+}
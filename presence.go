@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+)
+
+const SubscriptionSucceededAction = "subscription_succeeded"
+
+var errInvalidChannelData = errors.New("channel_data must be a JSON object with a user_id")
+var errPresenceUserMismatch = errors.New("channel_data user_id does not match the connection token subject")
+
+// Member is a user present in a presence channel. A user connected from
+// several sockets is a single Member holding all of those clients.
+type Member struct {
+	UserID   string          `json:"user_id"`
+	UserInfo json.RawMessage `json:"user_info,omitempty"`
+	clients  map[*Client]bool
+	// nodes are the other gosocks nodes where the user is connected.
+	nodes map[string]bool
+}
+
+// PresenceData is the member roster sent to a client joining a presence channel.
+type PresenceData struct {
+	IDs   []string                   `json:"ids"`
+	Hash  map[string]json.RawMessage `json:"hash"`
+	Count int                        `json:"count"`
+}
+
+// Subscription is a request from a client to subscribe to a channel. Member
+// is only set for presence channels, history only when replay was requested.
+type Subscription struct {
+	client  *Client
+	member  *Member
+	history *HistoryRequest
+}
+
+// parseChannelData reads the signed channel_data a client supplies when
+// joining a presence channel.
+func parseChannelData(channelData string) (*Member, error) {
+	var member Member
+
+	if err := json.Unmarshal([]byte(channelData), &member); err != nil || len(member.UserID) == 0 {
+		return nil, errInvalidChannelData
+	}
+
+	return &member, nil
+}
+
+func newMember(joining *Member) *Member {
+	return &Member{
+		UserID:   joining.UserID,
+		UserInfo: joining.UserInfo,
+		clients:  make(map[*Client]bool),
+		nodes:    make(map[string]bool),
+	}
+}
+
+func (member *Member) encode() json.RawMessage {
+	json, err := json.Marshal(member)
+	if err != nil {
+		return nil
+	}
+
+	return json
+}
+
+func (channel *Channel) presenceData() json.RawMessage {
+	presence := PresenceData{
+		IDs:   make([]string, 0, len(channel.members)),
+		Hash:  make(map[string]json.RawMessage),
+		Count: len(channel.members),
+	}
+
+	for userId, member := range channel.members {
+		presence.IDs = append(presence.IDs, userId)
+		presence.Hash[userId] = member.UserInfo
+	}
+
+	sort.Strings(presence.IDs)
+
+	json, err := json.Marshal(presence)
+	if err != nil {
+		return nil
+	}
+
+	return json
+}
+
+// publishPresence tells the other nodes that a user's first connection on this
+// node joined, or its last connection left.
+func (channel *Channel) publishPresence(kind string, member *Member) {
+	envelope := &BrokerEnvelope{Kind: kind, Member: member}
+
+	if _, err := channel.server.publishEnvelope(channel.server.channelTopic(channel.Name), envelope); err != nil {
+		log.Printf("Error on publishing presence for channel %s %s", channel.Name, err)
+	}
+}
+
+// addRemoteMember records a user connected on another node, notifying local
+// clients if the user was not present anywhere yet.
+func (channel *Channel) addRemoteMember(node string, joining *Member) {
+	member, ok := channel.members[joining.UserID]
+
+	if !ok {
+		member = newMember(joining)
+
+		channel.notifyMemberAdded(member)
+		channel.members[member.UserID] = member
+	}
+
+	member.nodes[node] = true
+}
+
+// removeRemoteMember forgets a user on another node, notifying local clients
+// once the user is not present on any node. It reports whether the user was
+// removed from the channel.
+func (channel *Channel) removeRemoteMember(node string, userId string) bool {
+	member, ok := channel.members[userId]
+
+	if !ok {
+		return false
+	}
+
+	delete(member.nodes, node)
+
+	if len(member.clients) > 0 || len(member.nodes) > 0 {
+		return false
+	}
+
+	delete(channel.members, member.UserID)
+	channel.notifyMemberRemoved(member)
+
+	return true
+}
+
+// requestPresence asks the other nodes to announce the users connected to
+// them, when this node starts tracking the channel or sees a node (re)join.
+func (channel *Channel) requestPresence() {
+	if !isPresenceChannelName(channel.Name) {
+		return
+	}
+
+	envelope := &BrokerEnvelope{Kind: BrokerPresenceSync}
+
+	if _, err := channel.server.publishEnvelope(channel.server.channelTopic(channel.Name), envelope); err != nil {
+		log.Printf("Error on publishing presence sync %s", err)
+	}
+}
+
+// syncPresence re-announces the users connected on this node, answering a
+// node that just started tracking the channel.
+func (channel *Channel) syncPresence() {
+	for _, member := range channel.members {
+		if len(member.clients) > 0 {
+			channel.publishPresence(BrokerMemberAdded, member)
+		}
+	}
+}
+
+// removeNode forgets every user connected on a node that left the cluster.
+// Every surviving node tells its own clients, but only the leader elected by
+// the NodeMonitor sends the member_removed webhooks.
+func (channel *Channel) removeNode(node string, leader bool) {
+	for _, member := range channel.members {
+		if !member.nodes[node] || !channel.removeRemoteMember(node, member.UserID) {
+			continue
+		}
+
+		if leader {
+			go memberWebhook(channel.server.app, channel.Name, member.UserID, MemberRemovedAction)
+		}
+	}
+}
+
+func (channel *Channel) findMember(client *Client) *Member {
+	for _, member := range channel.members {
+		if member.clients[client] {
+			return member
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// drainFrames returns every frame queued for the client.
+func drainFrames(client *Client) []*Message {
+	var messages []*Message
+
+	for {
+		select {
+
+		case frame := <-client.send:
+			var message Message
+			json.Unmarshal(frame, &message)
+			messages = append(messages, &message)
+
+		default:
+			return messages
+		}
+	}
+}
+
+func framesWithAction(client *Client, action string) []*Message {
+	var matching []*Message
+
+	for _, message := range drainFrames(client) {
+		if message.Action == action {
+			matching = append(matching, message)
+		}
+	}
+
+	return matching
+}
+
+func newTestPresenceChannel() *Channel {
+	server := newWebsocketServer(&App{Key: "key"}, newMemoryBroker(), "node", nil)
+	return NewChannel(server, "presence-room", true, 0)
+}
+
+func joinPresence(channel *Channel, client *Client, userId string) {
+	channel.subscribeClientInChannel(&Subscription{
+		client: client,
+		member: &Member{UserID: userId, UserInfo: json.RawMessage(`{"name":"` + userId + `"}`)},
+	})
+}
+
+func TestPresenceMembersPerUser(t *testing.T) {
+	channel := newTestPresenceChannel()
+
+	alice1 := newTestRecipient(channel.server)
+	alice2 := newTestRecipient(channel.server)
+	bob := newTestRecipient(channel.server)
+
+	joinPresence(channel, alice1, "alice")
+	joinPresence(channel, bob, "bob")
+
+	if added := framesWithAction(alice1, MemberAddedAction); len(added) != 1 {
+		t.Fatalf("got %d member_added for bob, want 1", len(added))
+	}
+
+	// A second socket of a present user is not a new member
+	joinPresence(channel, alice2, "alice")
+
+	if added := framesWithAction(bob, MemberAddedAction); len(added) != 0 {
+		t.Errorf("got member_added for alice's second socket")
+	}
+
+	if len(channel.members) != 2 {
+		t.Errorf("got %d members, want 2", len(channel.members))
+	}
+
+	// member_removed only once the user's last socket leaves
+	channel.unsubscribeClientInChannel(alice1)
+
+	if removed := framesWithAction(bob, MemberRemovedAction); len(removed) != 0 {
+		t.Errorf("got member_removed while alice is still connected")
+	}
+
+	channel.unsubscribeClientInChannel(alice2)
+
+	removed := framesWithAction(bob, MemberRemovedAction)
+
+	if len(removed) != 1 {
+		t.Fatalf("got %d member_removed, want 1", len(removed))
+	}
+
+	var member Member
+	json.Unmarshal(removed[0].Data, &member)
+
+	if member.UserID != "alice" {
+		t.Errorf("got member_removed for %q, want alice", member.UserID)
+	}
+}
+
+func TestPresenceRosterOnJoin(t *testing.T) {
+	channel := newTestPresenceChannel()
+
+	joinPresence(channel, newTestRecipient(channel.server), "bob")
+	joinPresence(channel, newTestRecipient(channel.server), "alice")
+	joinPresence(channel, newTestRecipient(channel.server), "alice")
+
+	carol := newTestRecipient(channel.server)
+	joinPresence(channel, carol, "carol")
+
+	succeeded := framesWithAction(carol, SubscriptionSucceededAction)
+
+	if len(succeeded) != 1 {
+		t.Fatalf("got %d subscription_succeeded, want 1", len(succeeded))
+	}
+
+	var roster PresenceData
+	if err := json.Unmarshal(succeeded[0].Data, &roster); err != nil {
+		t.Fatal(err)
+	}
+
+	if roster.Count != 3 || len(roster.IDs) != 3 {
+		t.Fatalf("got %+v, want 3 members", roster)
+	}
+
+	for i, userId := range []string{"alice", "bob", "carol"} {
+		if roster.IDs[i] != userId {
+			t.Errorf("got ids %v, want them sorted", roster.IDs)
+		}
+
+		if string(roster.Hash[userId]) != `{"name":"`+userId+`"}` {
+			t.Errorf("got info %s for %s", roster.Hash[userId], userId)
+		}
+	}
+}
+
+func TestNodeLeftWebhookSentOnce(t *testing.T) {
+	webhooks := make(chan WebhookPayload, 10)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload WebhookPayload
+		json.NewDecoder(r.Body).Decode(&payload)
+
+		if payload.Event == MemberRemovedAction {
+			webhooks <- payload
+		}
+
+		w.Write([]byte("{}"))
+	}))
+	defer receiver.Close()
+
+	heartbeat := func(node string) []byte {
+		payload, _ := json.Marshal(&BrokerEnvelope{Node: node, Kind: BrokerHeartbeat, Started: 1})
+		return payload
+	}
+
+	left := make(chan string, 10)
+
+	// Nodes a and b both see carol, connected on node c, until c goes silent.
+	// Node a has no clients of its own in the channel.
+	for _, node := range []string{"a", "b"} {
+		server := newWebsocketServer(&App{Key: "key", WebhookURL: receiver.URL}, newMemoryBroker(), node, nil)
+		channel := NewChannel(server, "presence-room", true, 0)
+
+		if node == "b" {
+			joinPresence(channel, newTestRecipient(server), "bob")
+		}
+
+		channel.handleEnvelope(&BrokerEnvelope{Kind: BrokerMemberAdded, Node: "c", Member: &Member{UserID: "carol"}})
+
+		monitor := newNodeMonitor(newMemoryBroker(), node)
+		monitor.OnNodeLeft(func(node string, leader bool) {
+			channel.handleEnvelope(&BrokerEnvelope{Kind: BrokerNodeLeft, Node: node, leader: leader})
+			left <- node
+		})
+
+		for _, other := range []string{"a", "b", "c"} {
+			monitor.receiveHeartbeat(heartbeat(other))
+		}
+
+		monitor.mu.Lock()
+		monitor.nodes["c"].seen = time.Now().Add(-2 * nodeTimeout)
+		monitor.mu.Unlock()
+
+		monitor.expireNodes()
+
+		if node := <-left; node != "c" {
+			t.Fatalf("got node %s left, want c", node)
+		}
+
+		if _, ok := channel.members["carol"]; ok {
+			t.Errorf("got carol still present on node %s", node)
+		}
+	}
+
+	select {
+
+	case payload := <-webhooks:
+		if payload.UserID != "carol" || payload.Channel != "presence-room" {
+			t.Errorf("got %+v, want member_removed for carol", payload)
+		}
+
+	case <-time.After(2 * time.Second):
+		t.Fatal("got no member_removed webhook")
+	}
+
+	select {
+
+	case payload := <-webhooks:
+		t.Errorf("got a second member_removed webhook %+v", payload)
+
+	case <-time.After(200 * time.Millisecond):
+	}
+}
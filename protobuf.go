@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProtobufSubprotocol selects binary Protocol Buffers frames, each one a
+// gosocks.Message as defined in proto/gosocks.proto.
+const ProtobufSubprotocol = "gosocks.protobuf"
+
+// Wire types used by proto/gosocks.proto.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errProtoMalformed = errors.New("malformed protobuf frame")
+
+// ProtobufCodec writes messages as binary Protocol Buffers frames, so clients
+// can use code generated from proto/gosocks.proto.
+type ProtobufCodec struct{}
+
+// protoMessage, protoChannel and protoSender mirror the JSON encoding of a
+// Message, its target and its sender, which the codec converts from and to.
+type protoMessage struct {
+	Action        string          `json:"action"`
+	Event         string          `json:"event"`
+	Name          string          `json:"name"`
+	Data          json.RawMessage `json:"data,omitempty"`
+	Target        *protoChannel   `json:"target"`
+	Sender        *protoSender    `json:"sender"`
+	Timestamp     int64           `json:"timestamp"`
+	Auth          string          `json:"auth,omitempty"`
+	ChannelData   string          `json:"channel_data,omitempty"`
+	UserID        string          `json:"user_id,omitempty"`
+	ID            string          `json:"id,omitempty"`
+	Sequence      uint64          `json:"sequence,omitempty"`
+	Receipt       bool            `json:"receipt,omitempty"`
+	CorrelationID string          `json:"correlation_id,omitempty"`
+	ReplyTo       string          `json:"reply_to,omitempty"`
+	SocketID      string          `json:"socket_id,omitempty"`
+	History       *HistoryRequest `json:"history,omitempty"`
+}
+
+type protoChannel struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Private bool   `json:"private"`
+}
+
+type protoSender struct {
+	ID string `json:"id"`
+}
+
+func (ProtobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (ProtobufCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func (ProtobufCodec) Encode(message []byte) ([]byte, error) {
+	var wire protoMessage
+
+	if err := json.Unmarshal(message, &wire); err != nil {
+		return nil, err
+	}
+
+	return wire.appendProto(make([]byte, 0, len(message))), nil
+}
+
+func (ProtobufCodec) Decode(frame []byte) ([]byte, error) {
+	var wire protoMessage
+
+	if err := wire.decodeProto(frame); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&wire)
+}
+
+func (message *protoMessage) appendProto(b []byte) []byte {
+	b = appendProtoString(b, 1, message.Action)
+	b = appendProtoString(b, 2, message.Event)
+	b = appendProtoString(b, 3, message.Name)
+	b = appendProtoString(b, 4, string(message.Data))
+
+	if message.Target != nil {
+		b = appendProtoMessage(b, 5, message.Target.appendProto(nil))
+	}
+
+	if message.Sender != nil {
+		b = appendProtoMessage(b, 6, message.Sender.appendProto(nil))
+	}
+
+	b = appendProtoVarint(b, 7, uint64(message.Timestamp))
+	b = appendProtoString(b, 8, message.Auth)
+	b = appendProtoString(b, 9, message.ChannelData)
+	b = appendProtoString(b, 10, message.UserID)
+	b = appendProtoString(b, 11, message.ID)
+	b = appendProtoVarint(b, 12, message.Sequence)
+	b = appendProtoBool(b, 13, message.Receipt)
+	b = appendProtoString(b, 14, message.CorrelationID)
+	b = appendProtoString(b, 15, message.ReplyTo)
+	b = appendProtoString(b, 16, message.SocketID)
+
+	if message.History != nil {
+		history := message.History
+
+		var h []byte
+		h = appendProtoVarint(h, 1, uint64(history.Limit))
+		h = appendProtoVarint(h, 2, uint64(history.Since))
+		h = appendProtoVarint(h, 3, history.FromSequence)
+		h = appendProtoVarint(h, 4, history.ToSequence)
+
+		b = appendProtoMessage(b, 17, h)
+	}
+
+	return b
+}
+
+func (channel *protoChannel) appendProto(b []byte) []byte {
+	b = appendProtoString(b, 1, channel.ID)
+	b = appendProtoString(b, 2, channel.Name)
+	return appendProtoBool(b, 3, channel.Private)
+}
+
+func (sender *protoSender) appendProto(b []byte) []byte {
+	return appendProtoString(b, 1, sender.ID)
+}
+
+func (message *protoMessage) decodeProto(data []byte) error {
+	return decodeProtoFields(data, func(reader *protoReader, number int, wireType int) (bool, error) {
+		var err error
+
+		switch {
+
+		case number == 5 && wireType == protoBytes:
+			message.Target = &protoChannel{}
+			err = reader.message(message.Target.decodeProto)
+
+		case number == 6 && wireType == protoBytes:
+			message.Sender = &protoSender{}
+			err = reader.message(message.Sender.decodeProto)
+
+		case number == 17 && wireType == protoBytes:
+			message.History = &HistoryRequest{}
+			err = reader.message(func(data []byte) error {
+				return decodeHistoryRequestProto(message.History, data)
+			})
+
+		case number == 4 && wireType == protoBytes:
+			message.Data, err = reader.bytes()
+
+		case wireType == protoBytes && message.stringField(number) != nil:
+			*message.stringField(number), err = reader.string()
+
+		case number == 7 && wireType == protoVarint:
+			var v uint64
+			v, err = reader.varint()
+			message.Timestamp = int64(v)
+
+		case number == 12 && wireType == protoVarint:
+			message.Sequence, err = reader.varint()
+
+		case number == 13 && wireType == protoVarint:
+			var v uint64
+			v, err = reader.varint()
+			message.Receipt = v != 0
+
+		default:
+			return false, nil
+		}
+
+		return true, err
+	})
+}
+
+// stringField returns the string field with the number, if any.
+func (message *protoMessage) stringField(number int) *string {
+	switch number {
+	case 1:
+		return &message.Action
+	case 2:
+		return &message.Event
+	case 3:
+		return &message.Name
+	case 8:
+		return &message.Auth
+	case 9:
+		return &message.ChannelData
+	case 10:
+		return &message.UserID
+	case 11:
+		return &message.ID
+	case 14:
+		return &message.CorrelationID
+	case 15:
+		return &message.ReplyTo
+	case 16:
+		return &message.SocketID
+	}
+
+	return nil
+}
+
+func (channel *protoChannel) decodeProto(data []byte) error {
+	return decodeProtoFields(data, func(reader *protoReader, number int, wireType int) (bool, error) {
+		var err error
+
+		switch {
+
+		case number == 1 && wireType == protoBytes:
+			channel.ID, err = reader.string()
+
+		case number == 2 && wireType == protoBytes:
+			channel.Name, err = reader.string()
+
+		case number == 3 && wireType == protoVarint:
+			var v uint64
+			v, err = reader.varint()
+			channel.Private = v != 0
+
+		default:
+			return false, nil
+		}
+
+		return true, err
+	})
+}
+
+func (sender *protoSender) decodeProto(data []byte) error {
+	return decodeProtoFields(data, func(reader *protoReader, number int, wireType int) (bool, error) {
+		var err error
+
+		switch {
+
+		case number == 1 && wireType == protoBytes:
+			sender.ID, err = reader.string()
+
+		default:
+			return false, nil
+		}
+
+		return true, err
+	})
+}
+
+func decodeHistoryRequestProto(history *HistoryRequest, data []byte) error {
+	return decodeProtoFields(data, func(reader *protoReader, number int, wireType int) (bool, error) {
+		if wireType != protoVarint || number < 1 || number > 4 {
+			return false, nil
+		}
+
+		v, err := reader.varint()
+
+		switch number {
+		case 1:
+			history.Limit = int(int64(v))
+		case 2:
+			history.Since = int64(v)
+		case 3:
+			history.FromSequence = v
+		case 4:
+			history.ToSequence = v
+		}
+
+		return true, err
+	})
+}
+
+// The append functions leave out fields holding their default value, as
+// proto3 does.
+
+func appendProtoTag(b []byte, number int, wireType int) []byte {
+	return appendVarint(b, uint64(number)<<3|uint64(wireType))
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+
+	return append(b, byte(v))
+}
+
+func appendProtoVarint(b []byte, number int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	return appendVarint(appendProtoTag(b, number, protoVarint), v)
+}
+
+func appendProtoBool(b []byte, number int, v bool) []byte {
+	if !v {
+		return b
+	}
+
+	return appendProtoVarint(b, number, 1)
+}
+
+func appendProtoString(b []byte, number int, s string) []byte {
+	if len(s) == 0 {
+		return b
+	}
+
+	b = appendVarint(appendProtoTag(b, number, protoBytes), uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendProtoMessage appends an embedded message, even an empty one, so a
+// set field stays set.
+func appendProtoMessage(b []byte, number int, message []byte) []byte {
+	b = appendVarint(appendProtoTag(b, number, protoBytes), uint64(len(message)))
+	return append(b, message...)
+}
+
+// protoReader reads the fields of an encoded protobuf message.
+type protoReader struct {
+	data []byte
+	pos  int
+}
+
+// decodeProtoFields calls decodeField for every field of an encoded message.
+// Fields it doesn't read are skipped, so newer clients can send fields this
+// server doesn't know.
+func decodeProtoFields(data []byte, decodeField func(reader *protoReader, number int, wireType int) (bool, error)) error {
+	reader := &protoReader{data: data}
+
+	for reader.pos < len(reader.data) {
+		tag, err := reader.varint()
+		if err != nil {
+			return err
+		}
+
+		number, wireType := int(tag>>3), int(tag&7)
+
+		if number == 0 {
+			return errProtoMalformed
+		}
+
+		read, err := decodeField(reader, number, wireType)
+		if err != nil {
+			return err
+		}
+
+		if !read {
+			if err := reader.skip(wireType); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (reader *protoReader) varint() (uint64, error) {
+	var v uint64
+
+	for shift := uint(0); shift < 64; shift += 7 {
+		if reader.pos >= len(reader.data) {
+			return 0, errProtoMalformed
+		}
+
+		c := reader.data[reader.pos]
+		reader.pos++
+
+		v |= uint64(c&0x7f) << shift
+
+		if c < 0x80 {
+			return v, nil
+		}
+	}
+
+	return 0, errProtoMalformed
+}
+
+func (reader *protoReader) bytes() ([]byte, error) {
+	n, err := reader.varint()
+	if err != nil {
+		return nil, err
+	}
+
+	if n > uint64(len(reader.data)-reader.pos) {
+		return nil, errProtoMalformed
+	}
+
+	b := reader.data[reader.pos : reader.pos+int(n)]
+	reader.pos += int(n)
+
+	return b, nil
+}
+
+func (reader *protoReader) string() (string, error) {
+	b, err := reader.bytes()
+	return string(b), err
+}
+
+func (reader *protoReader) message(decode func(data []byte) error) error {
+	b, err := reader.bytes()
+	if err != nil {
+		return err
+	}
+
+	return decode(b)
+}
+
+func (reader *protoReader) skip(wireType int) error {
+	var err error
+
+	switch wireType {
+
+	case protoVarint:
+		_, err = reader.varint()
+
+	case protoBytes:
+		_, err = reader.bytes()
+
+	case protoFixed64, protoFixed32:
+		size := 8
+		if wireType == protoFixed32 {
+			size = 4
+		}
+
+		if len(reader.data)-reader.pos < size {
+			return errProtoMalformed
+		}
+
+		reader.pos += size
+
+	default:
+		// Groups are not used by proto3
+		return errProtoMalformed
+	}
+
+	return err
+}
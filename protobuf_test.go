@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestProtobufRoundTripsMessage(t *testing.T) {
+	message := fullMessage()
+
+	// Data is carried as the JSON text it was sent as
+	message.Data = json.RawMessage(`{"z":1,"a":[true,null]}`)
+
+	want, got := roundTrip(t, ProtobufCodec{}, message)
+
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if string(got.Data) != string(message.Data) {
+		t.Errorf("got data %s, want %s", got.Data, message.Data)
+	}
+}
+
+func TestProtobufRoundTripsDefaults(t *testing.T) {
+	tests := []*Message{
+		{},
+		{Action: ErrorAction, Timestamp: -1},
+		{History: &HistoryRequest{}},
+		{Target: &Channel{}},
+	}
+
+	for _, test := range tests {
+		if want, got := roundTrip(t, ProtobufCodec{}, test); !reflect.DeepEqual(want, got) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestProtobufEncoding(t *testing.T) {
+	frame, err := ProtobufCodec{}.Encode([]byte(`{"action":"a","sequence":300,"receipt":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// action (1, bytes), sequence (12, varint 300) and receipt (13, varint)
+	want := []byte{0x0a, 0x01, 'a', 0x60, 0xac, 0x02, 0x68, 0x01}
+
+	if !bytes.Equal(frame, want) {
+		t.Errorf("got % x, want % x", frame, want)
+	}
+}
+
+func TestProtobufSkipsUnknownFields(t *testing.T) {
+	frame := []byte{
+		0x0a, 0x01, 'a', // action
+		0xa8, 0x06, 0x01, // field 101, varint
+		0xb2, 0x06, 0x02, 'x', 'y', // field 102, bytes
+		0xb9, 0x06, 0, 0, 0, 0, 0, 0, 0, 0, // field 103, fixed64
+		0xc5, 0x06, 0, 0, 0, 0, // field 104, fixed32
+		0x12, 0x01, 'e', // event
+	}
+
+	decoded, err := ProtobufCodec{}.Decode(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var message Message
+	json.Unmarshal(decoded, &message)
+
+	if message.Action != "a" || message.Event != "e" {
+		t.Errorf("got %s", decoded)
+	}
+}
+
+func TestProtobufDecodeRejects(t *testing.T) {
+	tests := map[string][]byte{
+		"field zero":      {0x00, 0x01},
+		"truncated tag":   {0x80},
+		"truncated bytes": {0x0a, 0x05, 'a'},
+		"truncated fixed": {0xb9, 0x06, 0, 0},
+		"group":           {0x0b},
+		"varint too long": {0x38, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"bad target":      {0x2a, 0x02, 0x0a, 0x05},
+	}
+
+	for name, frame := range tests {
+		if _, err := (ProtobufCodec{}).Decode(frame); err == nil {
+			t.Errorf("%s: decoded % x", name, frame)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Time allowed to connect to Redis.
+	redisDialTimeout = 5 * time.Second
+
+	// Time allowed for a command to be written and answered. A connection
+	// that doesn't answer in time is dropped and dialled again.
+	redisCommandTimeout = 5 * time.Second
+
+	// How often the subscriber connection is pinged, so a Redis that stopped
+	// answering is noticed even when nothing is published.
+	redisPingPeriod = 30 * time.Second
+
+	// Wait time before reconnecting the subscriber connection.
+	redisReconnectWait = time.Second
+)
+
+var errRedisProtocol = errors.New("redis protocol error")
+
+type redisError string
+
+func (err redisError) Error() string {
+	return "redis: " + string(err)
+}
+
+// RedisBroker publishes through Redis pub/sub, so every node connected to the
+// same Redis (or any server speaking the Redis protocol) sees every envelope.
+type RedisBroker struct {
+	address  string
+	password string
+	// timeout is the time allowed for a command, pingPeriod how often the
+	// subscriber connection is pinged.
+	timeout    time.Duration
+	pingPeriod time.Duration
+
+	publishConn *redisConn
+	publishMu   sync.Mutex
+
+	subscribeConn *redisConn
+	handlers      map[string]func(payload []byte)
+	closed        bool
+	subscribeMu   sync.Mutex
+}
+
+// newRedisBroker connects to the Redis at rawURL, which is either host:port
+// or redis://[:password@]host:port.
+func newRedisBroker(rawURL string) (*RedisBroker, error) {
+	broker, err := parseRedisURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := broker.connect(); err != nil {
+		return nil, err
+	}
+
+	return broker, nil
+}
+
+// parseRedisURL returns a broker for the Redis at rawURL, not connected yet.
+func parseRedisURL(rawURL string) (*RedisBroker, error) {
+	if len(rawURL) == 0 {
+		return nil, errors.New("REDIS_URL is required for the redis broker")
+	}
+
+	broker := &RedisBroker{
+		address:    rawURL,
+		timeout:    redisCommandTimeout,
+		pingPeriod: redisPingPeriod,
+		handlers:   make(map[string]func(payload []byte)),
+	}
+
+	if strings.Contains(rawURL, "://") {
+		parsed, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+
+		broker.address = parsed.Host
+		broker.password, _ = parsed.User.Password()
+	}
+
+	return broker, nil
+}
+
+// connect opens the publish connection and starts the subscriber.
+func (broker *RedisBroker) connect() error {
+	conn, err := broker.dial()
+	if err != nil {
+		return err
+	}
+
+	broker.publishConn = conn
+
+	go broker.runSubscriber()
+
+	return nil
+}
+
+func (broker *RedisBroker) Publish(topic string, payload []byte) (int, error) {
+	broker.publishMu.Lock()
+	defer broker.publishMu.Unlock()
+
+	var err error
+
+	// Retry once on a fresh connection if the current one went away
+	for attempt := 0; attempt < 2; attempt++ {
+		if broker.publishConn == nil {
+			if broker.publishConn, err = broker.dial(); err != nil {
+				return 0, err
+			}
+		}
+
+		var reply interface{}
+
+		if reply, err = broker.publishConn.do("PUBLISH", topic, string(payload)); err == nil {
+			receivers, _ := reply.(int64)
+			return int(receivers), nil
+		}
+
+		if _, ok := err.(redisError); ok {
+			return 0, err
+		}
+
+		broker.publishConn.close()
+		broker.publishConn = nil
+
+		// A Redis that stopped answering would only hold up publishers again
+		if isTimeout(err) {
+			return 0, err
+		}
+	}
+
+	return 0, err
+}
+
+func (broker *RedisBroker) Subscribe(topic string, handler func(payload []byte)) error {
+	broker.subscribeMu.Lock()
+	defer broker.subscribeMu.Unlock()
+
+	broker.handlers[topic] = handler
+
+	// Without a connection the topic is subscribed on reconnect
+	if broker.subscribeConn == nil {
+		return nil
+	}
+
+	return broker.subscribeConn.write("SUBSCRIBE", topic)
+}
+
+func (broker *RedisBroker) Unsubscribe(topic string) error {
+	broker.subscribeMu.Lock()
+	defer broker.subscribeMu.Unlock()
+
+	delete(broker.handlers, topic)
+
+	if broker.subscribeConn == nil {
+		return nil
+	}
+
+	return broker.subscribeConn.write("UNSUBSCRIBE", topic)
+}
+
+func (broker *RedisBroker) Close() error {
+	broker.subscribeMu.Lock()
+	broker.closed = true
+	if broker.subscribeConn != nil {
+		broker.subscribeConn.close()
+	}
+	broker.subscribeMu.Unlock()
+
+	broker.publishMu.Lock()
+	defer broker.publishMu.Unlock()
+
+	if broker.publishConn != nil {
+		return broker.publishConn.close()
+	}
+
+	return nil
+}
+
+// runSubscriber keeps a subscriber connection open, resubscribing to every
+// topic after a reconnect, and dispatches published payloads to handlers.
+func (broker *RedisBroker) runSubscriber() {
+	for {
+		broker.subscribeMu.Lock()
+		closed := broker.closed
+		broker.subscribeMu.Unlock()
+
+		if closed {
+			return
+		}
+
+		conn, err := broker.dial()
+
+		if err != nil {
+			log.Printf("Error on connecting redis subscriber %s", err)
+			time.Sleep(redisReconnectWait)
+			continue
+		}
+
+		broker.subscribeMu.Lock()
+		broker.subscribeConn = conn
+
+		topics := make([]string, 0, len(broker.handlers))
+		for topic := range broker.handlers {
+			topics = append(topics, topic)
+		}
+
+		if len(topics) > 0 {
+			err = conn.write(append([]string{"SUBSCRIBE"}, topics...)...)
+		}
+		broker.subscribeMu.Unlock()
+
+		if err == nil {
+			done := make(chan struct{})
+			go broker.pingSubscriber(conn, done)
+
+			err = broker.readMessages(conn)
+			close(done)
+		}
+
+		log.Printf("Redis subscriber disconnected %s", err)
+
+		broker.subscribeMu.Lock()
+		broker.subscribeConn = nil
+		broker.subscribeMu.Unlock()
+
+		conn.close()
+		time.Sleep(redisReconnectWait)
+	}
+}
+
+// pingSubscriber pings the subscriber connection until done is closed. The
+// pongs keep readMessages from timing out.
+func (broker *RedisBroker) pingSubscriber(conn *redisConn, done chan struct{}) {
+	ticker := time.NewTicker(broker.pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+
+		case <-ticker.C:
+			broker.subscribeMu.Lock()
+			err := conn.write("PING")
+			broker.subscribeMu.Unlock()
+
+			if err != nil {
+				log.Printf("Error on pinging redis subscriber %s", err)
+				conn.close()
+				return
+			}
+
+		case <-done:
+			return
+		}
+	}
+}
+
+// readMessages dispatches the messages pushed to the subscriber connection,
+// until it fails or nothing, not even a pong, arrives for a ping period.
+func (broker *RedisBroker) readMessages(conn *redisConn) error {
+	for {
+		conn.conn.SetReadDeadline(time.Now().Add(broker.pingPeriod + broker.timeout))
+
+		reply, err := conn.readReply()
+		if err != nil {
+			return err
+		}
+
+		// Pushed messages are ["message", topic, payload]
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 {
+			continue
+		}
+
+		kind, _ := parts[0].([]byte)
+		topic, _ := parts[1].([]byte)
+		payload, _ := parts[2].([]byte)
+
+		if string(kind) != "message" {
+			continue
+		}
+
+		broker.subscribeMu.Lock()
+		handler, ok := broker.handlers[string(topic)]
+		broker.subscribeMu.Unlock()
+
+		if ok {
+			handler(payload)
+		}
+	}
+}
+
+// redisConn is a connection speaking the Redis serialization protocol.
+type redisConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+func (broker *RedisBroker) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", broker.address, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	redis := &redisConn{conn: conn, reader: bufio.NewReader(conn), timeout: broker.timeout}
+
+	if len(broker.password) > 0 {
+		if _, err := redis.do("AUTH", broker.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return redis, nil
+}
+
+// do sends a command and reads its reply, failing with a timeout when Redis
+// doesn't answer in time.
+func (redis *redisConn) do(args ...string) (interface{}, error) {
+	if err := redis.write(args...); err != nil {
+		return nil, err
+	}
+
+	redis.conn.SetReadDeadline(time.Now().Add(redis.timeout))
+	defer redis.conn.SetReadDeadline(time.Time{})
+
+	return redis.readReply()
+}
+
+func (redis *redisConn) write(args ...string) error {
+	redis.conn.SetWriteDeadline(time.Now().Add(redis.timeout))
+	var command strings.Builder
+
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	_, err := io.WriteString(redis.conn, command.String())
+
+	return err
+}
+
+// readReply reads one reply: simple strings as string, bulk strings as
+// []byte, integers as int64, arrays as []interface{} and errors as redisError.
+func (redis *redisConn) readReply() (interface{}, error) {
+	line, err := redis.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errRedisProtocol
+	}
+
+	switch line[0] {
+
+	case '+':
+		return line[1:], nil
+
+	case '-':
+		return nil, redisError(line[1:])
+
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(redis.reader, data); err != nil {
+			return nil, err
+		}
+
+		return data[:size], nil
+
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = redis.readReply(); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+			}
+		}
+
+		return items, nil
+	}
+
+	return nil, errRedisProtocol
+}
+
+func (redis *redisConn) close() error {
+	return redis.conn.Close()
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// redisStub is an in-process server speaking enough of the Redis protocol for
+// the broker: AUTH, PUBLISH, SUBSCRIBE, UNSUBSCRIBE and PING. While hung it
+// holds every command until resumed, like a Redis that stopped responding.
+type redisStub struct {
+	listener    net.Listener
+	password    string
+	hung        chan struct{}
+	dials       int
+	subscribers map[string]map[net.Conn]bool
+	mu          sync.Mutex
+}
+
+func newRedisStub(t *testing.T) *redisStub {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stub := &redisStub{
+		listener:    listener,
+		subscribers: make(map[string]map[net.Conn]bool),
+	}
+
+	go stub.serve()
+	t.Cleanup(func() { listener.Close() })
+
+	return stub
+}
+
+func (stub *redisStub) address() string {
+	return stub.listener.Addr().String()
+}
+
+func (stub *redisStub) serve() {
+	for {
+		conn, err := stub.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		stub.mu.Lock()
+		stub.dials++
+		stub.mu.Unlock()
+
+		go stub.serveConn(conn)
+	}
+}
+
+func (stub *redisStub) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	// The broker's own reader parses commands, which are arrays of bulk strings
+	reader := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	for {
+		reply, err := reader.readReply()
+		if err != nil {
+			stub.mu.Lock()
+			for _, conns := range stub.subscribers {
+				delete(conns, conn)
+			}
+			stub.mu.Unlock()
+			return
+		}
+
+		items, _ := reply.([]interface{})
+
+		args := make([]string, len(items))
+		for i, item := range items {
+			data, _ := item.([]byte)
+			args[i] = string(data)
+		}
+
+		stub.mu.Lock()
+		hung := stub.hung
+		stub.mu.Unlock()
+
+		if hung != nil {
+			<-hung
+		}
+
+		stub.handle(conn, args)
+	}
+}
+
+func (stub *redisStub) handle(conn net.Conn, args []string) {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+
+	if len(args) == 0 {
+		return
+	}
+
+	switch strings.ToUpper(args[0]) {
+
+	case "AUTH":
+		if len(args) == 2 && args[1] == stub.password {
+			fmt.Fprint(conn, "+OK\r\n")
+		} else {
+			fmt.Fprint(conn, "-ERR invalid password\r\n")
+		}
+
+	case "PUBLISH":
+		receivers := 0
+		for subscriber := range stub.subscribers[args[1]] {
+			fmt.Fprint(subscriber, "*3\r\n"+bulkString("message")+bulkString(args[1])+bulkString(args[2]))
+			receivers++
+		}
+
+		fmt.Fprintf(conn, ":%d\r\n", receivers)
+
+	case "SUBSCRIBE":
+		for _, topic := range args[1:] {
+			if stub.subscribers[topic] == nil {
+				stub.subscribers[topic] = make(map[net.Conn]bool)
+			}
+
+			stub.subscribers[topic][conn] = true
+			fmt.Fprint(conn, "*3\r\n"+bulkString("subscribe")+bulkString(topic)+":1\r\n")
+		}
+
+	case "UNSUBSCRIBE":
+		for _, topic := range args[1:] {
+			delete(stub.subscribers[topic], conn)
+			fmt.Fprint(conn, "*3\r\n"+bulkString("unsubscribe")+bulkString(topic)+":0\r\n")
+		}
+
+	case "PING":
+		// Subscribed connections are answered with a pong push
+		fmt.Fprint(conn, "*2\r\n"+bulkString("pong")+bulkString(""))
+
+	default:
+		fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+func bulkString(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func (stub *redisStub) hang() {
+	stub.mu.Lock()
+	stub.hung = make(chan struct{})
+	stub.mu.Unlock()
+}
+
+func (stub *redisStub) resume() {
+	stub.mu.Lock()
+	close(stub.hung)
+	stub.hung = nil
+	stub.mu.Unlock()
+}
+
+func (stub *redisStub) dialCount() int {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+
+	return stub.dials
+}
+
+func (stub *redisStub) subscriberCount(topic string) int {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+
+	return len(stub.subscribers[topic])
+}
+
+// newTestRedisBroker connects a broker to the stub, with short timeouts.
+func newTestRedisBroker(t *testing.T, rawURL string, timeout time.Duration) *RedisBroker {
+	broker, err := parseRedisURL(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker.timeout = timeout
+	broker.pingPeriod = timeout
+
+	if err := broker.connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { broker.Close() })
+
+	return broker
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedisBrokerPublishSubscribe(t *testing.T) {
+	stub := newRedisStub(t)
+
+	subscriber := newTestRedisBroker(t, stub.address(), time.Second)
+	publisher := newTestRedisBroker(t, "redis://"+stub.address(), time.Second)
+
+	received := make(chan []byte, 1)
+
+	if err := subscriber.Subscribe("app:channel:a", func(payload []byte) { received <- payload }); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the subscription", func() bool { return stub.subscriberCount("app:channel:a") == 1 })
+
+	receivers, err := publisher.Publish("app:channel:a", []byte(`{"kind":"message"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if receivers != 1 {
+		t.Errorf("got %d receivers, want 1", receivers)
+	}
+
+	select {
+
+	case payload := <-received:
+		if string(payload) != `{"kind":"message"}` {
+			t.Errorf("got payload %s", payload)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("published payload never received")
+	}
+
+	if err := subscriber.Unsubscribe("app:channel:a"); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the unsubscription", func() bool { return stub.subscriberCount("app:channel:a") == 0 })
+
+	if receivers, _ := publisher.Publish("app:channel:a", []byte("{}")); receivers != 0 {
+		t.Errorf("got %d receivers after unsubscribing, want 0", receivers)
+	}
+}
+
+func TestRedisBrokerAuth(t *testing.T) {
+	stub := newRedisStub(t)
+	stub.password = "secret"
+
+	if _, err := newRedisBroker("redis://:wrong@" + stub.address()); err == nil {
+		t.Error("connected with the wrong password")
+	}
+
+	broker, err := newRedisBroker("redis://:secret@" + stub.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker.Close()
+}
+
+func TestRedisBrokerPublishTimeout(t *testing.T) {
+	stub := newRedisStub(t)
+
+	broker := newTestRedisBroker(t, stub.address(), 100*time.Millisecond)
+
+	stub.hang()
+
+	start := time.Now()
+
+	if _, err := broker.Publish("topic", []byte("{}")); !isTimeout(err) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+
+	// One timeout, not one per attempt
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("publish blocked for %s", elapsed)
+	}
+
+	if broker.publishConn != nil {
+		t.Errorf("kept the connection that timed out")
+	}
+
+	stub.resume()
+
+	if _, err := broker.Publish("topic", []byte("{}")); err != nil {
+		t.Fatalf("publish after the timeout failed %s", err)
+	}
+}
+
+func TestRedisBrokerSubscriberReconnects(t *testing.T) {
+	stub := newRedisStub(t)
+
+	broker := newTestRedisBroker(t, stub.address(), 100*time.Millisecond)
+
+	received := make(chan []byte, 1)
+	broker.Subscribe("topic", func(payload []byte) { received <- payload })
+
+	waitFor(t, "the subscription", func() bool { return stub.subscriberCount("topic") == 1 })
+
+	// Unanswered pings drop the subscriber connection
+	stub.hang()
+	dials := stub.dialCount()
+
+	waitFor(t, "a reconnect", func() bool { return stub.dialCount() > dials })
+
+	stub.resume()
+
+	// A new connection subscribes to the topic again
+	publisher := newTestRedisBroker(t, stub.address(), time.Second)
+
+	waitFor(t, "the delivery", func() bool {
+		publisher.Publish("topic", []byte("after"))
+
+		select {
+		case payload := <-received:
+			return string(payload) == "after"
+		default:
+			return false
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Maximum messages buffered for a dropped connection. Past it the oldest
+	// are dropped, which the client sees as a gap in the sequence numbers.
+	maxResumeBuffer = 1000
+)
+
+// Resumption is a new connection taking over a dropped session.
+type Resumption struct {
+	conn     *websocket.Conn
+	features Features
+}
+
+// detach keeps a client whose connection dropped in its channels for the
+// app's grace period, buffering what it is sent, so presence doesn't flap
+// when it resumes. The session ends like any disconnect once the grace
+// period is over.
+func (client *Client) detach() {
+	close(client.stop)
+	<-client.stopped
+
+	detached := time.Now()
+
+	client.wsServer.addSession(client)
+
+	var pending [][]byte
+
+	timer := time.NewTimer(time.Duration(client.wsServer.app.ResumeGracePeriod) * time.Second)
+	defer timer.Stop()
+
+	for {
+		select {
+
+		case message := <-client.send:
+			if len(pending) == maxResumeBuffer {
+				pending = pending[1:]
+			}
+
+			pending = append(pending, message)
+
+		case resumption := <-client.resume:
+			client.attach(resumption, pending, detached)
+			return
+
+		case <-timer.C:
+			// Unless a resume already took the session and is on its way
+			if client.wsServer.removeSession(client) {
+				client.disconnect()
+				return
+			}
+		}
+	}
+}
+
+// attach moves a session to its new connection, sending the handshake, the
+// messages still unacked from before it dropped and the messages buffered
+// while it was away before anything else.
+func (client *Client) attach(resumption *Resumption, pending [][]byte, detached time.Time) {
+	client.conn = resumption.conn
+	client.features = resumption.features
+	client.codec = codecFor(resumption.conn.Subprotocol())
+	client.stop = make(chan struct{})
+	client.stopped = make(chan struct{})
+
+	messages := [][]byte{client.connectionEstablished(resumption.features, true).encode()}
+	messages = append(messages, client.dueAcks(detached)...)
+	messages = append(messages, pending...)
+
+	// A failed write shows up in readPump, which detaches again
+	if err := client.writeMessages(messages); err != nil {
+		log.Printf("Error on resuming session %s", err)
+	}
+
+	go client.writePump()
+	go client.readPump()
+}
+
+func (server *WsServer) addSession(client *Client) {
+	server.sessionsMu.Lock()
+	server.sessions[client.resumeToken] = client
+	server.sessionsMu.Unlock()
+}
+
+// takeSession removes and returns the session with the resume token. The
+// connection resuming it must be authenticated as the same user.
+func (server *WsServer) takeSession(token string, claims *Claims) *Client {
+	userId := ""
+	if claims != nil {
+		userId = claims.Subject
+	}
+
+	server.sessionsMu.Lock()
+	defer server.sessionsMu.Unlock()
+
+	client, ok := server.sessions[token]
+
+	if !ok || client.UserID != userId {
+		return nil
+	}
+
+	delete(server.sessions, token)
+
+	return client
+}
+
+// removeSession ends waiting for a session to resume, reporting false if it
+// was already taken.
+func (server *WsServer) removeSession(client *Client) bool {
+	server.sessionsMu.Lock()
+	defer server.sessionsMu.Unlock()
+
+	if server.sessions[client.resumeToken] != client {
+		return false
+	}
+
+	delete(server.sessions, client.resumeToken)
+
+	return true
+}
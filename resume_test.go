@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// nextMessage returns the next message with the action on a JSON connection,
+// skipping the others.
+func nextMessage(t *testing.T, conn *websocket.Conn, action string) *Message {
+	t.Helper()
+
+	for {
+		_, frame := readFrame(t, conn)
+
+		var message Message
+		if err := json.Unmarshal(frame, &message); err != nil {
+			t.Fatal(err)
+		}
+
+		if message.Action == action {
+			return &message
+		}
+	}
+}
+
+func hasSession(server *WsServer, token string) bool {
+	server.sessionsMu.Lock()
+	defer server.sessionsMu.Unlock()
+
+	_, ok := server.sessions[token]
+
+	return ok
+}
+
+// dropConnection joins the connection to the channel and drops it without a
+// close frame, as a network failure would.
+func dropConnection(t *testing.T, server *WsServer, conn *websocket.Conn, token string, channelName string) {
+	t.Helper()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"join_channel","name":"`+channelName+`"}`))
+	nextMessage(t, conn, ChannelJoinedAction)
+
+	conn.UnderlyingConn().Close()
+
+	waitFor(t, "the session to wait for a resume", func() bool { return hasSession(server, token) })
+}
+
+func TestResumeWithinGracePeriod(t *testing.T) {
+	wsServer, server := newWsTestServer(t, &App{Key: "key", ResumeGracePeriod: 30})
+
+	conn := dialWs(t, server, "", false)
+	_, connection := readConnection(t, conn)
+	dropConnection(t, wsServer, conn, connection.ResumeToken, "chat")
+
+	// Messages sent while the connection is down are buffered
+	for i := 1; i <= 3; i++ {
+		if err := wsServer.triggerEvent("chat", "news", json.RawMessage(strconv.Itoa(i)), "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resumed := dialWs(t, server, "resume_token="+url.QueryEscape(connection.ResumeToken), false)
+	_, handshake := readConnection(t, resumed)
+
+	if !handshake.Resumed || handshake.SocketID != connection.SocketID {
+		t.Fatalf("got %+v, want socket %s resumed", handshake, connection.SocketID)
+	}
+
+	if len(handshake.ResumeToken) == 0 || handshake.ResumeToken == connection.ResumeToken {
+		t.Errorf("got resume token %q, want a new one", handshake.ResumeToken)
+	}
+
+	var sequence uint64
+
+	for i := 1; i <= 3; i++ {
+		message := nextMessage(t, resumed, SendMessageAction)
+
+		if string(message.Data) != strconv.Itoa(i) {
+			t.Fatalf("got data %s, want %d", message.Data, i)
+		}
+
+		if sequence > 0 && message.Sequence != sequence+1 {
+			t.Errorf("got sequence %d after %d", message.Sequence, sequence)
+		}
+
+		sequence = message.Sequence
+	}
+
+	// The session kept its channels
+	wsServer.triggerEvent("chat", "news", json.RawMessage("4"), "", "")
+
+	if message := nextMessage(t, resumed, SendMessageAction); string(message.Data) != "4" {
+		t.Errorf("got data %s, want 4", message.Data)
+	}
+}
+
+func TestResumeStartsFreshSession(t *testing.T) {
+	wsServer, server := newWsTestServer(t, &App{Key: "key", ResumeGracePeriod: 1})
+
+	conn := dialWs(t, server, "", false)
+	_, connection := readConnection(t, conn)
+	dropConnection(t, wsServer, conn, connection.ResumeToken, "chat")
+
+	resumed := dialWs(t, server, "resume_token="+url.QueryEscape(connection.ResumeToken), false)
+	if _, handshake := readConnection(t, resumed); !handshake.Resumed {
+		t.Fatal("got a fresh session, want it resumed")
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		// A token is only good for one resume
+		{"stale", connection.ResumeToken},
+		{"unknown", "unknown"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, handshake := readConnection(t, dialWs(t, server, "resume_token="+url.QueryEscape(test.token), false))
+
+			if handshake.Resumed || handshake.SocketID == connection.SocketID {
+				t.Errorf("got %+v, want a fresh session", handshake)
+			}
+		})
+	}
+
+	t.Run("expired", func(t *testing.T) {
+		conn := dialWs(t, server, "", false)
+		_, expired := readConnection(t, conn)
+		dropConnection(t, wsServer, conn, expired.ResumeToken, "chat")
+
+		waitFor(t, "the grace period to end", func() bool { return !hasSession(wsServer, expired.ResumeToken) })
+
+		_, handshake := readConnection(t, dialWs(t, server, "resume_token="+url.QueryEscape(expired.ResumeToken), false))
+
+		if handshake.Resumed || handshake.SocketID == expired.SocketID {
+			t.Errorf("got %+v, want a fresh session", handshake)
+		}
+	})
+}
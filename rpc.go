@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const RequestAction = "request"
+const ReplyAction = "reply"
+
+const ErrorCodeTimeout = 4008
+
+const (
+	// How long a request waits for a reply, when the app doesn't set
+	// RequestTimeout.
+	defaultRequestTimeout = 10 * time.Second
+
+	// Maximum requests a client can have waiting for a reply.
+	maxPendingRequests = 100
+
+	// Maximum requests sent to a client it can still reply to. Past it an
+	// earlier request is forgotten.
+	maxReceivedRequests = 1000
+)
+
+var (
+	errRequestNoCorrelation = errors.New("requests and replies require a correlation_id")
+	errRequestDuplicate     = errors.New("a request with this correlation_id is already waiting for a reply")
+	errRequestTooMany       = errors.New("too many requests waiting for a reply")
+	errRequestNoBackend     = errors.New("requests without a channel require a request_url for the app")
+	errRequestNotSubscribed = errors.New("requests require a subscription to the channel")
+	errReplyNoTarget        = errors.New("replies require the reply_to socket id of the request")
+	errReplyUnknown         = errors.New("no request with this correlation_id and reply_to was sent to this socket")
+	errRequestTimeout       = errors.New("no reply before the timeout")
+)
+
+// RPCRequest is posted to the app's RequestURL for requests without a
+// channel. The backend answers with an RPCReply body, or with 202 Accepted
+// and a later call to the reply endpoint.
+type RPCRequest struct {
+	CorrelationID string          `json:"correlation_id"`
+	SocketID      string          `json:"socket_id"`
+	UserID        string          `json:"user_id,omitempty"`
+	Event         string          `json:"event"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// RPCReply is the reply of a backend, returned to a RPCRequest or posted to
+// the reply endpoint with the SocketID of the request.
+type RPCReply struct {
+	CorrelationID string          `json:"correlation_id"`
+	SocketID      string          `json:"socket_id,omitempty"`
+	Event         string          `json:"event"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// handleRequest sends a request to the clients of a channel, or to the app's
+// backend when it has no channel, and waits for the first reply.
+func (client *Client) handleRequest(message *Message) {
+	if len(message.CorrelationID) == 0 {
+		client.sendError(message.Name, ErrorCodeBadRequest, errRequestNoCorrelation.Error())
+		return
+	}
+
+	var channel *Channel
+
+	if len(message.Name) > 0 {
+		var code int
+		var err error
+
+		if channel, code, err = client.authorizeRequest(message); err != nil {
+			client.sendError(message.Name, code, err.Error())
+			return
+		}
+	} else if len(client.wsServer.app.RequestURL) == 0 {
+		client.sendError(message.Name, ErrorCodeBadRequest, errRequestNoBackend.Error())
+		return
+	}
+
+	if err := client.expectReply(message); err != nil {
+		client.sendError(message.Name, ErrorCodeBadRequest, err.Error())
+		return
+	}
+
+	message.ReplyTo = client.GetId()
+	message.UserID = client.UserID
+	message.Timestamp = time.Now().Unix()
+
+	if channel == nil {
+		go client.requestBackend(message)
+		return
+	}
+
+	// Nobody answers their own request
+	message.exclude = client.GetId()
+
+	if err := client.wsServer.publish(channel.Name, message); err != nil {
+		client.cancelRequest(message.CorrelationID)
+		client.sendError(channel.Name, ErrorCodeBadRequest, err.Error())
+	}
+}
+
+// authorizeRequest checks that the client may send the request to the clients
+// of its channel, returning the channel or the error code and error to send
+// back. Requests are named like client events, and need the publish grant and
+// a subscription to the channel, on any kind of channel.
+func (client *Client) authorizeRequest(message *Message) (*Channel, int, error) {
+	if !isClientEvent(message.Event) {
+		return nil, ErrorCodeBadRequest, errNotClientEvent
+	}
+
+	if !client.isGranted(message.Name, GrantPublish) {
+		return nil, ErrorCodeForbidden, errPublishDenied
+	}
+
+	channel := client.wsServer.findChannelByName(message.Name)
+
+	if channel == nil || !client.isInChannel(channel) {
+		return nil, ErrorCodeForbidden, errRequestNotSubscribed
+	}
+
+	return channel, 0, nil
+}
+
+// receivedRequest identifies a request by the socket that made it and its
+// correlation id, which is only unique to that socket.
+type receivedRequest struct {
+	replyTo       string
+	correlationId string
+}
+
+// handleReplyMessage sends a client's reply to the socket that made the
+// request, on whichever node it is. Clients may only reply once, and only to
+// requests they were sent.
+func (client *Client) handleReplyMessage(message *Message) {
+	if len(message.CorrelationID) == 0 {
+		client.sendError(message.Name, ErrorCodeBadRequest, errRequestNoCorrelation.Error())
+		return
+	}
+
+	if len(message.ReplyTo) == 0 {
+		client.sendError(message.Name, ErrorCodeBadRequest, errReplyNoTarget.Error())
+		return
+	}
+
+	if !client.answerRequest(receivedRequest{message.ReplyTo, message.CorrelationID}) {
+		client.sendError(message.Name, ErrorCodeBadRequest, errReplyUnknown.Error())
+		return
+	}
+
+	client.wsServer.sendToSocket(message.ReplyTo, &Message{
+		Action:        ReplyAction,
+		Event:         message.Event,
+		Name:          message.Name,
+		Data:          message.Data,
+		Sender:        client,
+		Timestamp:     time.Now().Unix(),
+		UserID:        client.UserID,
+		CorrelationID: message.CorrelationID,
+	})
+}
+
+// expectReply registers a request of the client, sending it a timeout error
+// if no reply arrives in time.
+func (client *Client) expectReply(message *Message) error {
+	client.requestsMu.Lock()
+	defer client.requestsMu.Unlock()
+
+	if _, ok := client.requests[message.CorrelationID]; ok {
+		return errRequestDuplicate
+	}
+
+	if len(client.requests) >= maxPendingRequests {
+		return errRequestTooMany
+	}
+
+	name := message.Name
+	correlationId := message.CorrelationID
+
+	client.requests[correlationId] = time.AfterFunc(client.wsServer.app.requestTimeout(), func() {
+		client.requestsMu.Lock()
+		defer client.requestsMu.Unlock()
+
+		if _, ok := client.requests[correlationId]; !ok {
+			return
+		}
+
+		delete(client.requests, correlationId)
+
+		timeout := newErrorMessage(name, ErrorCodeTimeout, errRequestTimeout.Error())
+		timeout.CorrelationID = correlationId
+
+		client.send <- timeout.encode()
+	})
+
+	return nil
+}
+
+// receiveRequest records a request sent to the client, so it can reply to it
+// until the request times out.
+func (client *Client) receiveRequest(message *Message) {
+	key := receivedRequest{message.ReplyTo, message.CorrelationID}
+
+	client.receivedMu.Lock()
+	defer client.receivedMu.Unlock()
+
+	if timer, ok := client.received[key]; ok {
+		timer.Stop()
+	} else if len(client.received) >= maxReceivedRequests {
+		for oldest, timer := range client.received {
+			timer.Stop()
+			delete(client.received, oldest)
+			break
+		}
+	}
+
+	client.received[key] = time.AfterFunc(client.wsServer.app.requestTimeout(), func() {
+		client.receivedMu.Lock()
+		defer client.receivedMu.Unlock()
+
+		delete(client.received, key)
+	})
+}
+
+// answerRequest forgets a request sent to the client, reporting whether it
+// was still waiting for the client's reply.
+func (client *Client) answerRequest(key receivedRequest) bool {
+	client.receivedMu.Lock()
+	defer client.receivedMu.Unlock()
+
+	timer, ok := client.received[key]
+
+	if ok {
+		timer.Stop()
+		delete(client.received, key)
+	}
+
+	return ok
+}
+
+// receiveReply passes the first reply to a waiting request on to the client,
+// dropping late and unexpected replies.
+func (client *Client) receiveReply(reply *Message) {
+	client.requestsMu.Lock()
+	defer client.requestsMu.Unlock()
+
+	timer, ok := client.requests[reply.CorrelationID]
+
+	if !ok {
+		return
+	}
+
+	timer.Stop()
+	delete(client.requests, reply.CorrelationID)
+
+	client.send <- reply.encode()
+}
+
+func (client *Client) cancelRequest(correlationId string) {
+	client.requestsMu.Lock()
+	defer client.requestsMu.Unlock()
+
+	if timer, ok := client.requests[correlationId]; ok {
+		timer.Stop()
+		delete(client.requests, correlationId)
+	}
+}
+
+// cancelRequests stops waiting for replies once the client is gone, before
+// its send channel is closed.
+func (client *Client) cancelRequests() {
+	client.requestsMu.Lock()
+	defer client.requestsMu.Unlock()
+
+	for correlationId, timer := range client.requests {
+		timer.Stop()
+		delete(client.requests, correlationId)
+	}
+
+	client.receivedMu.Lock()
+	defer client.receivedMu.Unlock()
+
+	for key, timer := range client.received {
+		timer.Stop()
+		delete(client.received, key)
+	}
+}
+
+// requestBackend posts a request to the app's RequestURL. A reply in the
+// response body is passed on straight away, otherwise the backend replies
+// through the reply endpoint.
+func (client *Client) requestBackend(message *Message) {
+	data, err := json.Marshal(RPCRequest{
+		CorrelationID: message.CorrelationID,
+		SocketID:      client.GetId(),
+		UserID:        client.UserID,
+		Event:         message.Event,
+		Data:          message.Data,
+	})
+
+	if err != nil {
+		log.Printf("Error on sending request to backend %s", err)
+		return
+	}
+
+	httpClient := &http.Client{Timeout: client.wsServer.app.requestTimeout()}
+	response, err := httpClient.Post(client.wsServer.app.RequestURL, "application/json; charset=utf-8", bytes.NewBuffer(data))
+
+	if err != nil {
+		log.Printf("Error on sending request to backend %s", err)
+		return
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return
+	}
+
+	var reply RPCReply
+
+	if err := json.NewDecoder(io.LimitReader(response.Body, maxEventBodySize)).Decode(&reply); err != nil {
+		log.Printf("Error on reading backend reply %s", err)
+		return
+	}
+
+	reply.CorrelationID = message.CorrelationID
+
+	// The client hears of a reply too large to pass on, not just a timeout
+	if len(reply.Data) > client.wsServer.app.maxDataSize() {
+		log.Printf("Error on reading backend reply %s", errDataTooLarge)
+
+		tooLarge := newErrorMessage(message.Name, ErrorCodeBadRequest, errDataTooLarge.Error())
+		tooLarge.CorrelationID = message.CorrelationID
+
+		client.receiveReply(tooLarge)
+		return
+	}
+
+	client.receiveReply(reply.message())
+}
+
+func (reply *RPCReply) message() *Message {
+	return &Message{
+		Action:        ReplyAction,
+		Event:         reply.Event,
+		Data:          reply.Data,
+		Timestamp:     time.Now().Unix(),
+		CorrelationID: reply.CorrelationID,
+	}
+}
+
+// serveReply handles replies posted by backend services to requests they
+// accepted earlier.
+func serveReply(wsServer *WsServer, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reply RPCReply
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxEventBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&reply); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	if len(reply.SocketID) == 0 || len(reply.CorrelationID) == 0 {
+		http.Error(w, "socket_id and correlation_id are required", http.StatusBadRequest)
+		return
+	}
+
+	if len(reply.Data) > wsServer.app.maxDataSize() {
+		http.Error(w, "Data too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	wsServer.sendToSocket(reply.SocketID, reply.message())
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func newTestRecipient(server *WsServer) *Client {
+	return &Client{
+		ID:       uuid.New(),
+		wsServer: server,
+		send:     make(chan []byte, 10),
+		received: make(map[receivedRequest]*time.Timer),
+	}
+}
+
+// nextFrame returns the action of the next frame sent to the client, if any.
+func nextFrame(client *Client) string {
+	select {
+
+	case frame := <-client.send:
+		var message Message
+		json.Unmarshal(frame, &message)
+		return message.Action
+
+	default:
+		return ""
+	}
+}
+
+func TestReplyRequiresRequest(t *testing.T) {
+	server := newWebsocketServer(&App{Key: "key"}, newMemoryBroker(), "node", nil)
+
+	replies := make(chan *BrokerEnvelope, 10)
+	go func() {
+		for envelope := range server.direct {
+			replies <- envelope
+		}
+	}()
+
+	recipient := newTestRecipient(server)
+	reply := &Message{Action: ReplyAction, CorrelationID: "1", ReplyTo: "requester"}
+
+	// A reply to a request the socket was never sent is forged
+	recipient.handleReplyMessage(reply)
+
+	if action := nextFrame(recipient); action != ErrorAction {
+		t.Errorf("got %q, want the reply rejected", action)
+	}
+
+	recipient.receiveRequest(&Message{Action: RequestAction, CorrelationID: "1", ReplyTo: "requester"})
+	recipient.handleReplyMessage(reply)
+
+	select {
+
+	case envelope := <-replies:
+		if envelope.Socket != "requester" || envelope.Message.CorrelationID != "1" {
+			t.Errorf("got reply %+v for %s", envelope.Message, envelope.Socket)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("reply never sent")
+	}
+
+	// Each request is answered once
+	recipient.handleReplyMessage(reply)
+
+	if action := nextFrame(recipient); action != ErrorAction {
+		t.Errorf("got %q, want the second reply rejected", action)
+	}
+}
+
+func TestReceivedRequestsAreBounded(t *testing.T) {
+	recipient := newTestRecipient(newWebsocketServer(&App{Key: "key"}, newMemoryBroker(), "node", nil))
+
+	for i := 0; i < maxReceivedRequests+10; i++ {
+		recipient.receiveRequest(&Message{CorrelationID: uuid.New().String(), ReplyTo: "requester"})
+	}
+
+	if len(recipient.received) != maxReceivedRequests {
+		t.Errorf("got %d requests, want %d", len(recipient.received), maxReceivedRequests)
+	}
+
+	recipient.cancelRequests()
+
+	if len(recipient.received) != 0 {
+		t.Errorf("kept %d requests after cancelling", len(recipient.received))
+	}
+}
+
+func TestBackendReplyDataLimit(t *testing.T) {
+	data := `{"ok":true}`
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"event":"reply","data":%s}`, data)
+	}))
+	defer backend.Close()
+
+	server := newWebsocketServer(&App{Key: "key", RequestURL: backend.URL, MaxDataSize: 32}, newMemoryBroker(), "node", nil)
+
+	client := newTestRecipient(server)
+	client.requests = make(map[string]*time.Timer)
+
+	request := func(correlationId string) *Message {
+		message := &Message{Action: RequestAction, CorrelationID: correlationId}
+		client.expectReply(message)
+		client.requestBackend(message)
+
+		var reply Message
+		json.Unmarshal(<-client.send, &reply)
+
+		return &reply
+	}
+
+	if reply := request("1"); reply.Action != ReplyAction || string(reply.Data) != data {
+		t.Errorf("got %s %s, want the reply", reply.Action, reply.Data)
+	}
+
+	data = `"` + strings.Repeat("a", 32) + `"`
+
+	if reply := request("2"); reply.Action != ErrorAction || reply.CorrelationID != "2" {
+		t.Errorf("got %s for %s, want an error for the request", reply.Action, reply.CorrelationID)
+	}
+}
+
+func TestRequestAuthorization(t *testing.T) {
+	tests := []struct {
+		name       string
+		channel    string
+		event      string
+		grants     []ChannelGrant
+		subscribed bool
+		err        error
+	}{
+		{"public channel", "chat", "client-ping", nil, true, nil},
+		{"private channel", "private-chat", "client-ping", nil, true, nil},
+		{"granted", "chat", "client-ping", []ChannelGrant{{Pattern: "chat", Subscribe: true, Publish: true}}, true, nil},
+		{"not a client event", "chat", "ping", nil, true, errNotClientEvent},
+		{"no publish grant", "chat", "client-ping", []ChannelGrant{{Pattern: "chat", Subscribe: true}}, true, errPublishDenied},
+		{"not subscribed", "chat", "client-ping", nil, false, errRequestNotSubscribed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Client events are off, requests don't depend on them
+			server := newWebsocketServer(&App{Key: "key"}, newMemoryBroker(), "node", nil)
+
+			channel := NewChannel(server, test.channel, isPrivateChannelName(test.channel), 0)
+			server.channels[channel] = true
+
+			sender := newTestRecipient(server)
+			sender.requests = make(map[string]*time.Timer)
+			sender.grants = test.grants
+			sender.channels = map[*Channel]bool{}
+
+			receiver := newTestRecipient(server)
+			receiver.channels = map[*Channel]bool{channel: true}
+			channel.subscribeClientInChannel(&Subscription{client: receiver})
+
+			if test.subscribed {
+				sender.channels[channel] = true
+				channel.subscribeClientInChannel(&Subscription{client: sender})
+			}
+
+			drainFrames(sender)
+			drainFrames(receiver)
+
+			sendClientEvent(channel, sender, `{"action":"request","name":"`+test.channel+`","event":"`+test.event+`","correlation_id":"1"}`)
+			sender.cancelRequests()
+
+			requests := framesWithAction(receiver, RequestAction)
+
+			if test.err == nil {
+				if len(requests) != 1 || requests[0].ReplyTo != sender.GetId() {
+					t.Errorf("got %+v, want the request delivered", requests)
+				}
+
+				return
+			}
+
+			if len(requests) != 0 {
+				t.Errorf("got %d requests delivered, want none", len(requests))
+			}
+
+			rejected := framesWithAction(sender, ErrorAction)
+			if len(rejected) != 1 {
+				t.Fatalf("got %d errors, want 1", len(rejected))
+			}
+
+			var data ErrorData
+			json.Unmarshal(rejected[0].Data, &data)
+
+			if data.Message != test.err.Error() {
+				t.Errorf("got error %q, want %q", data.Message, test.err)
+			}
+		})
+	}
+}
@@ -1,28 +1,70 @@
 package main
 
-import "time"
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var errChannelNotFound = errors.New("channel not found")
 
 type WsServer struct {
+	app         *App
+	broker      Broker
+	history     HistoryStore
+	nodeId      string
 	clients     map[*Client]bool
 	subscribe   chan *Client
 	unsubscribe chan *Client
 	broadcast   chan []byte
 	channels    map[*Channel]bool
+	// channelsMu guards channels, which is read and written from client
+	// goroutines as well as HTTP handlers.
+	channelsMu  sync.RWMutex
+	connections atomic.Int64
+	// direct carries messages for a single socket or user, on whichever node
+	// they are.
+	direct chan *BrokerEnvelope
+	// sessions are the clients waiting to be resumed, by resume token.
+	sessions   map[string]*Client
+	sessionsMu sync.Mutex
+	// streams are the Server-Sent Events connections, by socket id. A
+	// client's POSTs must reach the node holding its stream.
+	streams   map[string]*Stream
+	streamsMu sync.Mutex
 }
 
-// newWebsocketServer creates a new WsServer type
-func newWebsocketServer() *WsServer {
+// newWebsocketServer creates a new WsServer type for an app, sharing
+// broadcasts with other nodes through broker and keeping channel history in
+// history
+func newWebsocketServer(app *App, broker Broker, nodeId string, history HistoryStore) *WsServer {
 	return &WsServer{
+		app:         app,
+		broker:      broker,
+		history:     history,
+		nodeId:      nodeId,
 		clients:     make(map[*Client]bool),
 		subscribe:   make(chan *Client),
 		unsubscribe: make(chan *Client),
 		broadcast:   make(chan []byte),
 		channels:    make(map[*Channel]bool),
+		direct:      make(chan *BrokerEnvelope),
+		sessions:    make(map[string]*Client),
+		streams:     make(map[string]*Stream),
 	}
 }
 
 // Run our websocket server, accepting various requests
 func (server *WsServer) Run() {
+	if err := server.broker.Subscribe(server.serverTopic(), server.receiveEnvelope); err != nil {
+		log.Printf("Error on subscribing to broker %s", err)
+	}
+
 	for {
 		select {
 
@@ -34,6 +76,9 @@ func (server *WsServer) Run() {
 
 		case message := <-server.broadcast:
 			server.broadcastToClients(message)
+
+		case envelope := <-server.direct:
+			server.deliverDirect(envelope)
 		}
 
 	}
@@ -61,6 +106,7 @@ func (server *WsServer) notifyClientJoined(client *Client) {
 	}
 
 	server.broadcastToClients(message.encode())
+	server.publishServerMessage(message)
 }
 
 func (server *WsServer) notifyClientLeft(client *Client) {
@@ -73,6 +119,7 @@ func (server *WsServer) notifyClientLeft(client *Client) {
 	}
 
 	server.broadcastToClients(message.encode())
+	server.publishServerMessage(message)
 }
 
 func (server *WsServer) listOnlineClients(client *Client) {
@@ -81,7 +128,7 @@ func (server *WsServer) listOnlineClients(client *Client) {
 			Action:    MemberAddedAction,
 			Event:     MemberAddedAction,
 			Sender:    existingClient,
-			Timestamp: 9000,
+			Timestamp: time.Now().Unix(),
 		}
 		client.send <- message.encode()
 	}
@@ -93,7 +140,27 @@ func (server *WsServer) broadcastToClients(message []byte) {
 	}
 }
 
+// acquireConnection reserves a connection slot, enforcing the app's
+// MaxConnections limit.
+func (server *WsServer) acquireConnection() bool {
+	connections := server.connections.Add(1)
+
+	if server.app.MaxConnections > 0 && connections > int64(server.app.MaxConnections) {
+		server.connections.Add(-1)
+		return false
+	}
+
+	return true
+}
+
+func (server *WsServer) releaseConnection() {
+	server.connections.Add(-1)
+}
+
 func (server *WsServer) findChannelByName(name string) *Channel {
+	server.channelsMu.RLock()
+	defer server.channelsMu.RUnlock()
+
 	var foundChannel *Channel
 	for channel := range server.channels {
 		if channel.GetName() == name {
@@ -106,13 +173,131 @@ func (server *WsServer) findChannelByName(name string) *Channel {
 }
 
 func (server *WsServer) createChannel(name string, private bool) *Channel {
-	channel := NewChannel(name, private)
+	// The history store may read from disk, so don't hold up every lookup
+	sequence := server.lastSequence(name)
+
+	server.channelsMu.Lock()
+
+	// Another client may have created the channel since it was looked up
+	for channel := range server.channels {
+		if channel.GetName() == name {
+			server.channelsMu.Unlock()
+			return channel
+		}
+	}
+
+	channel := NewChannel(server, name, private, sequence)
 	go channel.RunChannel()
+
 	server.channels[channel] = true
+	server.channelsMu.Unlock()
 
 	return channel
 }
 
+// notifyChannels hands an envelope to every channel of the server, as if it
+// was published to each of them.
+func (server *WsServer) notifyChannels(envelope *BrokerEnvelope) {
+	server.channelsMu.RLock()
+	channels := make([]*Channel, 0, len(server.channels))
+	for channel := range server.channels {
+		channels = append(channels, channel)
+	}
+	server.channelsMu.RUnlock()
+
+	for _, channel := range channels {
+		channel.remote <- envelope
+	}
+}
+
+// triggerEvent pushes an event into a channel, the same way a client's
+// send_message would. The socket with id socketId, if any, is excluded from
+// the broadcast. Delivery receipts on ack channels go to receiptTo, if set.
+func (server *WsServer) triggerEvent(channelName string, event string, data json.RawMessage, socketId string, receiptTo string) error {
+	return server.publish(channelName, &Message{
+		Action:    SendMessageAction,
+		Event:     event,
+		Name:      channelName,
+		Data:      data,
+		Timestamp: time.Now().Unix(),
+		Receipt:   len(receiptTo) > 0,
+		receiptTo: receiptTo,
+		exclude:   socketId,
+	})
+}
+
+// publish broadcasts a message on a channel, on this node and every other
+// node. It fails with errChannelNotFound when no node has the channel.
+func (server *WsServer) publish(channelName string, message *Message) error {
+	channel := server.findChannelByName(channelName)
+
+	message.ID = uuid.New().String()
+
+	receivers, err := server.publishEnvelope(server.channelTopic(channelName), &BrokerEnvelope{
+		Kind:    BrokerMessage,
+		Message: message,
+		Exclude: message.exclude,
+		Receipt: message.receiptTo,
+	})
+
+	if err != nil {
+		log.Printf("Error on publishing to broker %s", err)
+	}
+
+	if channel == nil {
+		if receivers == 0 {
+			return errChannelNotFound
+		}
+
+		return nil
+	}
+
+	message.Target = channel
+	channel.broadcast <- message
+
+	return nil
+}
+
+// sendToSocket sends a message to the socket with the id, which may be
+// connected to this node or any other.
+func (server *WsServer) sendToSocket(socketId string, message *Message) {
+	envelope := &BrokerEnvelope{Kind: BrokerSocket, Message: message, Socket: socketId}
+
+	if _, err := server.publishEnvelope(server.serverTopic(), envelope); err != nil {
+		log.Printf("Error on publishing to broker %s", err)
+	}
+
+	server.direct <- envelope
+}
+
+func (server *WsServer) publishServerMessage(message *Message) {
+	envelope := &BrokerEnvelope{Kind: BrokerMessage, Message: message}
+
+	if _, err := server.publishEnvelope(server.serverTopic(), envelope); err != nil {
+		log.Printf("Error on publishing to broker %s", err)
+	}
+}
+
+// publishEnvelope stamps the envelope with this node and publishes it.
+func (server *WsServer) publishEnvelope(topic string, envelope *BrokerEnvelope) (int, error) {
+	envelope.Node = server.nodeId
+
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return 0, err
+	}
+
+	return server.broker.Publish(topic, payload)
+}
+
+func (server *WsServer) channelTopic(name string) string {
+	return server.app.Key + ":channel:" + name
+}
+
+func (server *WsServer) serverTopic() string {
+	return server.app.Key + ":server"
+}
+
 // UNUSED FOR NOW
 /*
 func (server *WsServer) findChannelByID(ID string) *Channel {
@@ -126,7 +311,10 @@ func (server *WsServer) findChannelByID(ID string) *Channel {
 
 	return foundChannel
 }
+*/
 
+// findClientByID returns the client with the socket id on this node. Only
+// used from the Run goroutine, which owns clients.
 func (server *WsServer) findClientByID(ID string) *Client {
 	var foundClient *Client
 	for client := range server.clients {
@@ -138,4 +326,3 @@ func (server *WsServer) findClientByID(ID string) *Client {
 
 	return foundClient
 }
-*/
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var errStreamNotFound = errors.New("no event stream with this socket_id")
+
+// Stream is a Server-Sent Events connection, for clients that can't keep a
+// websocket open. Its Client has no websocket: the GET request streams what
+// the client is sent, and frames the client POSTs with its socket_id are
+// handled one at a time, as a websocket's readPump would.
+type Stream struct {
+	client *Client
+	frames chan []byte
+	done   chan struct{}
+}
+
+// serveSSE streams the channels listed in the channels query parameter as
+// text/event-stream, or handles a frame POSTed by the client of a stream. The
+// connection_established of a stream carries the stream_token its frames are
+// posted with.
+// Channel messages carry an event id that, sent back as Last-Event-ID on
+// reconnect, replays what the client missed in channels that keep history.
+func serveSSE(wsServer *WsServer, w http.ResponseWriter, r *http.Request) {
+	claims, _ := r.Context().Value(claimsContextKey).(*Claims)
+
+	if r.Method == http.MethodPost {
+		serveStreamFrame(wsServer, claims, w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	if !wsServer.acquireConnection() {
+		log.Printf("Connection limit reached for app %s", wsServer.app.ID)
+		http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+		return
+	}
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if len(lastEventId) == 0 {
+		lastEventId = r.URL.Query().Get("last_event_id")
+	}
+
+	cursor, _ := url.ParseQuery(lastEventId)
+
+	var joins []Message
+
+	for _, name := range strings.Split(r.URL.Query().Get("channels"), ",") {
+		if len(name) == 0 {
+			continue
+		}
+
+		join := Message{Action: JoinChannelAction, Name: name}
+
+		// Pick up after the last message the client saw before reconnecting
+		if sequence, err := strconv.ParseUint(cursor.Get(name), 10, 64); err == nil {
+			join.History = &HistoryRequest{FromSequence: sequence + 1}
+		}
+
+		joins = append(joins, join)
+	}
+
+	client := newClient(nil, wsServer, claims)
+	client.codec = JSONCodec{}
+	client.streamToken = uuid.New().String()
+
+	stream := &Stream{
+		client: client,
+		frames: make(chan []byte),
+		done:   make(chan struct{}),
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	client.notifyConnectionEstablished(Features{Encoding: client.codec.Name()})
+
+	wsServer.addStream(stream)
+
+	go stream.readFrames(joins)
+
+	stream.writeEvents(w, flusher, r, cursor)
+
+	close(stream.done)
+	wsServer.removeStream(stream)
+
+	// Keep draining until the client is unsubscribed everywhere
+	for range client.send {
+	}
+}
+
+// readFrames joins the requested channels and then handles the frames the
+// client posts, until the stream ends.
+func (stream *Stream) readFrames(joins []Message) {
+	client := stream.client
+
+	defer client.disconnect()
+
+	client.wsServer.subscribe <- client
+
+	for _, join := range joins {
+		join.Sender = client
+		client.joinChannel(join)
+	}
+
+	for {
+		select {
+
+		case frame := <-stream.frames:
+			client.handleNewMessage(frame)
+
+		case <-stream.done:
+			return
+		}
+	}
+}
+
+// writeEvents writes what the client is sent as events, until the request
+// ends. Channel messages get the cursor of the last sequence seen in every
+// channel as their event id.
+func (stream *Stream) writeEvents(w io.Writer, flusher http.Flusher, r *http.Request, cursor url.Values) {
+	client := stream.client
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	// Only apps with ack channels have messages to send again
+	var redeliver <-chan time.Time
+
+	if len(client.wsServer.app.AckChannels) > 0 {
+		ackTicker := time.NewTicker(ackCheckPeriod)
+		defer ackTicker.Stop()
+
+		redeliver = ackTicker.C
+	}
+
+	write := func(messages [][]byte) error {
+		for _, message := range messages {
+			if err := writeEvent(w, message, cursor); err != nil {
+				return err
+			}
+		}
+
+		flusher.Flush()
+		return nil
+	}
+
+	for {
+		select {
+
+		case message := <-client.send:
+			messages := [][]byte{message}
+
+			n := len(client.send)
+			for i := 0; i < n; i++ {
+				messages = append(messages, <-client.send)
+			}
+
+			if err := write(messages); err != nil {
+				log.Printf("sse error on write %s", err)
+				return
+			}
+
+		case <-ticker.C:
+			// A comment keeps proxies from timing out an idle stream
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				log.Printf("sse error on write %s", err)
+				return
+			}
+
+			flusher.Flush()
+
+		case <-redeliver:
+			if err := write(client.dueAcks(time.Now().Add(-client.wsServer.app.ackTimeout()))); err != nil {
+				log.Printf("sse error on redelivery %s", err)
+				return
+			}
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeEvent writes a message as an event, with an id when it is numbered in
+// its channel.
+func writeEvent(w io.Writer, message []byte, cursor url.Values) error {
+	var position struct {
+		Name     string `json:"name"`
+		Sequence uint64 `json:"sequence"`
+	}
+
+	if err := json.Unmarshal(message, &position); err == nil && position.Sequence > 0 {
+		cursor.Set(position.Name, strconv.FormatUint(position.Sequence, 10))
+
+		if _, err := io.WriteString(w, "id: "+cursor.Encode()+"\n"); err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(w, "data: "+string(message)+"\n\n")
+	return err
+}
+
+// serveStreamFrame hands a frame POSTed by a client to its event stream. The
+// request must carry the stream's socket_id, its stream token in the
+// X-Stream-Token header, and be authenticated as the same user.
+func serveStreamFrame(wsServer *WsServer, claims *Claims, w http.ResponseWriter, r *http.Request) {
+	stream := wsServer.findStream(r.URL.Query().Get("socket_id"))
+
+	userId := ""
+	if claims != nil {
+		userId = claims.Subject
+	}
+
+	token := r.Header.Get("X-Stream-Token")
+
+	if stream == nil || stream.client.UserID != userId || !validStreamToken(stream, token) {
+		http.Error(w, errStreamNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	frame, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageSize))
+	if err != nil {
+		http.Error(w, "Message too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	select {
+
+	case stream.frames <- frame:
+		w.WriteHeader(http.StatusAccepted)
+
+	case <-stream.done:
+		http.Error(w, errStreamNotFound.Error(), http.StatusNotFound)
+	}
+}
+
+// validStreamToken compares the token in constant time, so it can't be
+// guessed a byte at a time.
+func validStreamToken(stream *Stream, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(stream.client.streamToken), []byte(token)) == 1
+}
+
+func (server *WsServer) addStream(stream *Stream) {
+	server.streamsMu.Lock()
+	server.streams[stream.client.GetId()] = stream
+	server.streamsMu.Unlock()
+}
+
+func (server *WsServer) removeStream(stream *Stream) {
+	server.streamsMu.Lock()
+	delete(server.streams, stream.client.GetId())
+	server.streamsMu.Unlock()
+}
+
+func (server *WsServer) findStream(socketId string) *Stream {
+	server.streamsMu.Lock()
+	defer server.streamsMu.Unlock()
+
+	return server.streams[socketId]
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is an event read from a stream.
+type sseEvent struct {
+	id      string
+	message Message
+}
+
+// sseStream reads the events of a stream opened on the test server.
+type sseStream struct {
+	response *http.Response
+	events   chan sseEvent
+}
+
+func newSSETestServer(t *testing.T) (*WsServer, *httptest.Server) {
+	app := &App{Key: "key", HistorySize: 10}
+	wsServer := newWebsocketServer(app, newMemoryBroker(), "node", newMemoryHistoryStore(app.HistorySize, 0))
+	app.server = wsServer
+
+	go wsServer.Run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveSSE(wsServer, w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return wsServer, server
+}
+
+func openSSEStream(t *testing.T, server *httptest.Server, channels string, lastEventId string) *sseStream {
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"?channels="+channels, nil)
+
+	if len(lastEventId) > 0 {
+		request.Header.Set("Last-Event-ID", lastEventId)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { response.Body.Close() })
+
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("got content type %s", contentType)
+	}
+
+	stream := &sseStream{response: response, events: make(chan sseEvent, 100)}
+
+	go func() {
+		scanner := bufio.NewScanner(response.Body)
+		var event sseEvent
+
+		for scanner.Scan() {
+			line := scanner.Text()
+
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				event.id = strings.TrimPrefix(line, "id: ")
+
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.message)
+
+			case len(line) == 0 && len(event.message.Action) > 0:
+				stream.events <- event
+				event = sseEvent{}
+			}
+		}
+
+		close(stream.events)
+	}()
+
+	return stream
+}
+
+// next returns the next event with the action, skipping others.
+func (stream *sseStream) next(t *testing.T, action string) sseEvent {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+
+	for {
+		select {
+
+		case event, ok := <-stream.events:
+			if !ok {
+				t.Fatalf("stream ended waiting for %s", action)
+			}
+
+			if event.message.Action == action {
+				return event
+			}
+
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", action)
+		}
+	}
+}
+
+// connection reads the connection_established of the stream.
+func (stream *sseStream) connection(t *testing.T) ConnectionData {
+	t.Helper()
+
+	var connection ConnectionData
+	json.Unmarshal(stream.next(t, ConnectionEstablishedAction).message.Data, &connection)
+
+	return connection
+}
+
+func postFrame(t *testing.T, server *httptest.Server, socketId string, token string, frame string) int {
+	request, _ := http.NewRequest(http.MethodPost, server.URL+"?socket_id="+url.QueryEscape(socketId), strings.NewReader(frame))
+
+	if len(token) > 0 {
+		request.Header.Set("X-Stream-Token", token)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response.Body.Close()
+
+	return response.StatusCode
+}
+
+func TestSSEStreamLifecycle(t *testing.T) {
+	wsServer, server := newSSETestServer(t)
+
+	stream := openSSEStream(t, server, "chat", "")
+
+	connection := stream.connection(t)
+
+	if len(connection.SocketID) == 0 || len(connection.StreamToken) == 0 {
+		t.Fatalf("got %+v, want a socket id and stream token", connection)
+	}
+
+	stream.next(t, ChannelJoinedAction)
+
+	wsServer.triggerEvent("chat", "event", json.RawMessage(`{"n":1}`), "", "")
+
+	if event := stream.next(t, SendMessageAction); string(event.message.Data) != `{"n":1}` || event.id != "chat=1" {
+		t.Errorf("got %s with id %q", event.message.Data, event.id)
+	}
+
+	leave := `{"action":"leave_channel","name":"chat"}`
+
+	// Frames need the stream's token, not just its socket id
+	if status := postFrame(t, server, connection.SocketID, "", leave); status != http.StatusNotFound {
+		t.Errorf("got status %d for a frame without the token", status)
+	}
+
+	if status := postFrame(t, server, connection.SocketID, "guess", leave); status != http.StatusNotFound {
+		t.Errorf("got status %d for a frame with the wrong token", status)
+	}
+
+	if status := postFrame(t, server, connection.SocketID, connection.StreamToken, leave); status != http.StatusAccepted {
+		t.Fatalf("got status %d for a frame with the token", status)
+	}
+
+	// The frame is handled as it would be from a websocket
+	if event := stream.next(t, LeaveChannelAction); event.message.Name != "chat" {
+		t.Errorf("left %s, want chat", event.message.Name)
+	}
+
+	// Closing the stream removes it
+	stream.response.Body.Close()
+
+	waitFor(t, "the stream to be removed", func() bool {
+		return wsServer.findStream(connection.SocketID) == nil
+	})
+
+	if status := postFrame(t, server, connection.SocketID, connection.StreamToken, leave); status != http.StatusNotFound {
+		t.Errorf("got status %d for a frame to a closed stream", status)
+	}
+}
+
+func TestSSELastEventIDReplay(t *testing.T) {
+	wsServer, server := newSSETestServer(t)
+
+	stream := openSSEStream(t, server, "chat,news", "")
+	connection := stream.connection(t)
+
+	stream.next(t, ChannelJoinedAction)
+	stream.next(t, ChannelJoinedAction)
+
+	wsServer.triggerEvent("chat", "event", json.RawMessage(`"chat 1"`), "", "")
+	wsServer.triggerEvent("news", "event", json.RawMessage(`"news 1"`), "", "")
+
+	stream.next(t, SendMessageAction)
+	seen := stream.next(t, SendMessageAction)
+
+	// The id holds the position in every channel
+	if cursor, _ := url.ParseQuery(seen.id); cursor.Get("chat") != "1" || cursor.Get("news") != "1" {
+		t.Fatalf("got id %q, want both channels", seen.id)
+	}
+
+	stream.response.Body.Close()
+
+	waitFor(t, "the stream to be removed", func() bool {
+		return wsServer.findStream(connection.SocketID) == nil
+	})
+
+	// Missed while disconnected
+	wsServer.triggerEvent("chat", "event", json.RawMessage(`"chat 2"`), "", "")
+	wsServer.triggerEvent("news", "event", json.RawMessage(`"news 2"`), "", "")
+
+	reconnected := openSSEStream(t, server, "chat,news", seen.id)
+
+	got := map[string]string{}
+	for i := 0; i < 2; i++ {
+		event := reconnected.next(t, SendMessageAction)
+		got[event.message.Name] = string(event.message.Data)
+	}
+
+	if got["chat"] != `"chat 2"` || got["news"] != `"news 2"` {
+		t.Errorf("replayed %v, want only the missed messages", got)
+	}
+
+	select {
+	case event := <-reconnected.events:
+		if event.message.Action == SendMessageAction {
+			t.Errorf("replayed %s again", event.message.Data)
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWriteEventCursor(t *testing.T) {
+	cursor := url.Values{}
+	var events strings.Builder
+
+	writeEvent(&events, []byte(`{"action":"send_message","name":"a","sequence":3}`), cursor)
+	writeEvent(&events, []byte(`{"action":"send_message","name":"b","sequence":7}`), cursor)
+	writeEvent(&events, []byte(`{"action":"channel_joined","name":"a"}`), cursor)
+
+	want := "id: a=3\ndata: {\"action\":\"send_message\",\"name\":\"a\",\"sequence\":3}\n\n" +
+		"id: a=3&b=7\ndata: {\"action\":\"send_message\",\"name\":\"b\",\"sequence\":7}\n\n" +
+		"data: {\"action\":\"channel_joined\",\"name\":\"a\"}\n\n"
+
+	if events.String() != want {
+		t.Errorf("got %q, want %q", events.String(), want)
+	}
+}
@@ -6,17 +6,47 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"os"
 )
 
-func webhook(clientId string, event string) {
-	url := os.Getenv("WEBHOOK_URL")
+// WebhookPayload is the body posted to the WEBHOOK_URL.
+type WebhookPayload struct {
+	ClientID string `json:"client_id,omitempty"`
+	UserID   string `json:"user_id,omitempty"`
+	Channel  string `json:"channel,omitempty"`
+	Event    string `json:"event"`
+	// MessageID is the message of a delivery_receipt or delivery_failed.
+	MessageID string `json:"message_id,omitempty"`
+}
+
+func webhook(client *Client, event string) {
+	sendWebhook(client.wsServer.app.WebhookURL, WebhookPayload{
+		ClientID: client.GetId(),
+		UserID:   client.UserID,
+		Event:    event,
+	})
+}
+
+// memberWebhook reports a presence change that has no local client, such as
+// the users of a node that left the cluster.
+func memberWebhook(app *App, channelName string, userId string, event string) {
+	sendWebhook(app.WebhookURL, WebhookPayload{
+		UserID:  userId,
+		Channel: channelName,
+		Event:   event,
+	})
+}
 
+func sendWebhook(url string, payload WebhookPayload) {
 	if len(url) == 0 {
 		return
 	}
 
-	data := []byte(`{"client_id":"` + clientId + `","event":"` + event + `"}`)
+	data, err := json.Marshal(payload)
+
+	if err != nil {
+		log.Printf("Error on sending client webhook %s", err)
+		return
+	}
 
 	// create new http request
 	request, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
@@ -29,8 +59,8 @@ func webhook(clientId string, event string) {
 	request.Header.Set("Content-Type", "application/json; charset=utf-8")
 
 	// send the request
-	client := &http.Client{}
-	response, err := client.Do(request)
+	httpClient := &http.Client{}
+	response, err := httpClient.Do(request)
 
 	if err != nil {
 		log.Printf("Error on sending client webhook %s", err)